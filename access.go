@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+
+	"github.com/Acebond/ReverseSocks5/acl"
+	"github.com/Acebond/ReverseSocks5/mux"
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// Hostnames are resolved by the agent, so the server can only match address
+// rules against requests for an IP address. A request by hostname that an
+// address rule may match is left for the agent to decide: the rules that
+// apply are sent to it on the request's stream, and it checks them against
+// the addresses the hostname resolves to.
+
+// streamRules is what the server sends the agent out of band on a request's
+// stream, before the request.
+type streamRules struct {
+	ACL string `json:"acl"` // rules to check once hostnames are resolved
+}
+
+// allowed checks the access control list for user reaching dest through
+// agent a, logging requests it denies to logger. Requests by hostname the
+// list cannot decide yet are allowed, for the agent to check.
+func allowed(logger *slog.Logger, rules *acl.List, user string, a *Agent, dest statute.AddrSpec) bool {
+	rule, decided := rules.Decide(acl.Request{
+		User:  user,
+		Agent: a.Name,
+		FQDN:  dest.FQDN,
+		IP:    dest.IP,
+		Port:  dest.Port,
+	})
+	if !decided || rule == nil || rule.Action == acl.Allow {
+		return true
+	}
+	metrics.streamFailures.add("denied", 1)
+	logger.Info("Denied by the access control list", "user", user, "dest", dest.String(), "agent", a.ID, "acl_line", rule.Line)
+	return false
+}
+
+// allowedAnyAgent checks the rules that decide whether user may reach dest
+// whichever agent it goes through, so that a request they deny is refused
+// without waiting for an agent. Rules for particular agents are left to
+// allowed.
+func allowedAnyAgent(logger *slog.Logger, rules *acl.List, user string, dest statute.AddrSpec) bool {
+	rule, decided := rules.MatchAnyAgent(acl.Request{
+		User: user,
+		FQDN: dest.FQDN,
+		IP:   dest.IP,
+		Port: dest.Port,
+	})
+	if !decided || rule == nil || rule.Action == acl.Allow {
+		return true
+	}
+	metrics.streamFailures.add("denied", 1)
+	logger.Info("Denied by the access control list", "user", user, "dest", dest.String(), "acl_line", rule.Line)
+	return false
+}
+
+// allowedOnStream is allowed for a request on stream. If dest is a hostname,
+// the address rules are sent for the agent to check, and the request is
+// denied if they cannot be.
+func allowedOnStream(logger *slog.Logger, rules *acl.List, user string, a *Agent, stream net.Conn, dest statute.AddrSpec) bool {
+	if !allowed(logger, rules, user, a, dest) {
+		return false
+	}
+	if dest.FQDN == "" {
+		return true
+	}
+	return sentStreamRules(logger, rules, user, a, stream)
+}
+
+// sentStreamRules sends the rules that apply to user's requests through agent
+// a on stream, if any of them need the address a hostname resolves to. It
+// logs the failure and reports false if they could not be sent.
+func sentStreamRules(logger *slog.Logger, rules *acl.List, user string, a *Agent, stream net.Conn) bool {
+	l := rules.For(user, a.Name)
+	s, ok := stream.(*mux.Stream)
+	if l == nil || !ok {
+		return true
+	}
+	b, err := json.Marshal(streamRules{ACL: l.String()})
+	if err == nil {
+		err = s.SendReport(b)
+	}
+	if err != nil {
+		metrics.streamFailures.add("denied", 1)
+		logger.Warn("Denied, the access control list could not be sent to the agent", "err", err)
+		return false
+	}
+	return true
+}
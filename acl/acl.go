@@ -0,0 +1,384 @@
+// Package acl implements destination access control lists.
+//
+// A list is read from text with one rule per line:
+//
+//	allow|deny [user=<glob>] [agent=<glob>] <destination> [<ports>]
+//
+// The destination is "*", an IP address, a CIDR network or a hostname glob
+// such as "*.corp.example", and ports is a comma separated list of ports and
+// port ranges such as "80,443,8000-8100". Blank lines and lines starting with
+// '#' are ignored. The first rule that matches a request decides it, and
+// requests that match no rule are allowed.
+//
+// Address rules only match requests whose IP address is known and hostname
+// rules only match requests for a hostname. A request for a hostname that has
+// already been resolved is matched by both. Where hostnames are resolved
+// elsewhere, Decide leaves requests an address rule may match undecided, and
+// the rules For returns have to be checked there once the address is known.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Action is what a rule does with the requests it matches.
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// A Request is a destination a client asked for.
+type Request struct {
+	User  string
+	Agent string
+	// FQDN is set for requests by hostname, IP once the address is known
+	FQDN string
+	IP   net.IP
+	Port int
+}
+
+// A Rule is a single line of a List.
+type Rule struct {
+	Line   int
+	Text   string
+	Action Action
+	User   string // glob, matches every user if empty
+	Agent  string // glob, matches every agent if empty
+
+	// the destination, at most one of these is set
+	Net  *net.IPNet
+	Host string // lower case glob
+
+	Ports []PortRange // matches every port if empty
+}
+
+// A PortRange is an inclusive range of ports.
+type PortRange struct {
+	Low, High int
+}
+
+// Matches reports whether the rule applies to req.
+func (r *Rule) Matches(req Request) bool {
+	if r.User != "" && !glob(r.User, req.User) {
+		return false
+	}
+	if r.Agent != "" && !glob(r.Agent, req.Agent) {
+		return false
+	}
+
+	switch {
+	case r.Net != nil:
+		if req.IP == nil || !r.Net.Contains(req.IP) {
+			return false
+		}
+	case r.Host != "":
+		if req.FQDN == "" || !glob(r.Host, strings.ToLower(strings.TrimSuffix(req.FQDN, "."))) {
+			return false
+		}
+	}
+
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, pr := range r.Ports {
+		if req.Port >= pr.Low && req.Port <= pr.High {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the rule as it is parsed.
+func (r *Rule) String() string {
+	fields := []string{r.Action.String()}
+	if r.User != "" {
+		fields = append(fields, "user="+r.User)
+	}
+	if r.Agent != "" {
+		fields = append(fields, "agent="+r.Agent)
+	}
+	switch {
+	case r.Net != nil:
+		fields = append(fields, r.Net.String())
+	case r.Host != "":
+		fields = append(fields, r.Host)
+	default:
+		fields = append(fields, "*")
+	}
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, pr := range r.Ports {
+			ports[i] = strconv.Itoa(pr.Low)
+			if pr.High != pr.Low {
+				ports[i] += "-" + strconv.Itoa(pr.High)
+			}
+		}
+		fields = append(fields, strings.Join(ports, ","))
+	}
+	return strings.Join(fields, " ")
+}
+
+func glob(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// A List is an ordered list of rules. A nil List allows everything.
+type List struct {
+	Rules []Rule
+}
+
+// Match returns the first rule that matches req, or nil if none does.
+func (l *List) Match(req Request) *Rule {
+	if l == nil {
+		return nil
+	}
+	for i := range l.Rules {
+		if l.Rules[i].Matches(req) {
+			return &l.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Decide returns the first rule that matches req, or nil if none does. It
+// reports false if an address rule comes first that may match once the
+// hostname of req is resolved, so that the address has to be known to decide.
+func (l *List) Decide(req Request) (*Rule, bool) {
+	return l.decide(req, false)
+}
+
+// MatchAnyAgent is Decide for req whichever agent it is made through,
+// ignoring req.Agent. It also reports false if a rule for particular agents
+// comes first, so that the agent has to be known to decide.
+func (l *List) MatchAnyAgent(req Request) (*Rule, bool) {
+	return l.decide(req, true)
+}
+
+func (l *List) decide(req Request, anyAgent bool) (*Rule, bool) {
+	if l == nil {
+		return nil, true
+	}
+	for i := range l.Rules {
+		r := l.Rules[i]
+		if anyAgent {
+			r.Agent = ""
+		}
+		if req.IP == nil {
+			r.Net = nil
+		}
+		if !r.Matches(req) {
+			continue
+		}
+		if r.Agent != l.Rules[i].Agent || r.Net != l.Rules[i].Net {
+			return nil, false
+		}
+		return &l.Rules[i], true
+	}
+	return nil, true
+}
+
+// For returns the rules that apply to user's requests through agent, without
+// their user and agent options. It returns nil if none of them are address
+// rules, which are the only ones that need a hostname to be resolved.
+func (l *List) For(user, agent string) *List {
+	if l == nil {
+		return nil
+	}
+	var rules []Rule
+	hasAddress := false
+	for _, r := range l.Rules {
+		if r.User != "" && !glob(r.User, user) || r.Agent != "" && !glob(r.Agent, agent) {
+			continue
+		}
+		r.User, r.Agent = "", ""
+		r.Text = r.String()
+		rules = append(rules, r)
+		hasAddress = hasAddress || r.Net != nil
+	}
+	if !hasAddress {
+		return nil
+	}
+	return &List{Rules: rules}
+}
+
+// String returns the rules one per line, as they are parsed.
+func (l *List) String() string {
+	var b strings.Builder
+	for i := range l.Rules {
+		b.WriteString(l.Rules[i].String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Allowed reports whether req is allowed.
+func (l *List) Allowed(req Request) bool {
+	r := l.Match(req)
+	return r == nil || r.Action == Allow
+}
+
+// Load reads a list from a file.
+func Load(name string) (*List, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", name, err)
+	}
+	return l, nil
+}
+
+// Append adds the rules of other after those of l.
+func (l *List) Append(other *List) {
+	l.Rules = append(l.Rules, other.Rules...)
+}
+
+// Parse reads a list, errors are prefixed with the line number.
+func Parse(r io.Reader) (*List, error) {
+	l := &List{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", lineNo, err)
+		}
+		rule.Line, rule.Text = lineNo, line
+		l.Rules = append(l.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ParseRule parses a single rule.
+func ParseRule(line string) (Rule, error) {
+	var rule Rule
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return rule, fmt.Errorf("empty rule")
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	default:
+		return rule, fmt.Errorf("rule must start with allow or deny, not %q", fields[0])
+	}
+	fields = fields[1:]
+
+	for len(fields) > 0 {
+		key, value, ok := strings.Cut(fields[0], "=")
+		if !ok {
+			break
+		}
+		switch key {
+		case "user":
+			rule.User = value
+		case "agent":
+			rule.Agent = value
+		default:
+			return rule, fmt.Errorf("unknown option %q", key)
+		}
+		if _, err := path.Match(value, ""); err != nil {
+			return rule, fmt.Errorf("bad %s pattern %q", key, value)
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return rule, fmt.Errorf("missing destination")
+	}
+	if err := rule.parseDest(fields[0]); err != nil {
+		return rule, err
+	}
+	fields = fields[1:]
+
+	if len(fields) > 0 {
+		var err error
+		if rule.Ports, err = parsePorts(fields[0]); err != nil {
+			return rule, err
+		}
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		return rule, fmt.Errorf("unexpected %q", fields[0])
+	}
+	return rule, nil
+}
+
+func (r *Rule) parseDest(dest string) error {
+	if dest == "*" {
+		return nil
+	}
+	if strings.Contains(dest, "/") {
+		_, n, err := net.ParseCIDR(dest)
+		if err != nil {
+			return fmt.Errorf("bad network %q", dest)
+		}
+		r.Net = n
+		return nil
+	}
+	if ip := net.ParseIP(dest); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+	if _, err := path.Match(dest, ""); err != nil {
+		return fmt.Errorf("bad hostname pattern %q", dest)
+	}
+	r.Host = strings.ToLower(strings.TrimSuffix(dest, "."))
+	return nil
+}
+
+func parsePorts(spec string) ([]PortRange, error) {
+	if spec == "*" {
+		return nil, nil
+	}
+	var ports []PortRange
+	for _, part := range strings.Split(spec, ",") {
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		pr := PortRange{}
+		var err1, err2 error
+		pr.Low, err1 = strconv.Atoi(low)
+		pr.High, err2 = strconv.Atoi(high)
+		if err1 != nil || err2 != nil || pr.Low < 0 || pr.High > 65535 || pr.Low > pr.High {
+			return nil, fmt.Errorf("bad port range %q", part)
+		}
+		ports = append(ports, pr)
+	}
+	return ports, nil
+}
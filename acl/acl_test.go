@@ -0,0 +1,119 @@
+package acl
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, text string) *List {
+	t.Helper()
+	l, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		req   Request
+		// the line of the deciding rule, 0 for none
+		wantLine    int
+		wantDecided bool
+	}{
+		{
+			name:        "allowlisted network, hostname",
+			rules:       "allow 10.0.0.0/8\ndeny *",
+			req:         Request{FQDN: "intranet.corp", Port: 443},
+			wantDecided: false,
+		},
+		{
+			name:        "allowlisted network, address inside",
+			rules:       "allow 10.0.0.0/8\ndeny *",
+			req:         Request{IP: net.ParseIP("10.1.2.3"), Port: 443},
+			wantLine:    1,
+			wantDecided: true,
+		},
+		{
+			name:        "allowlisted network, address outside",
+			rules:       "allow 10.0.0.0/8\ndeny *",
+			req:         Request{IP: net.ParseIP("192.0.2.1"), Port: 443},
+			wantLine:    2,
+			wantDecided: true,
+		},
+		{
+			name:        "allowlisted network, resolved hostname",
+			rules:       "allow 10.0.0.0/8\ndeny *",
+			req:         Request{FQDN: "intranet.corp", IP: net.ParseIP("10.1.2.3"), Port: 443},
+			wantLine:    1,
+			wantDecided: true,
+		},
+		{
+			name:        "denied network, hostname",
+			rules:       "deny 10.0.0.0/8\nallow *",
+			req:         Request{FQDN: "intranet.corp", Port: 443},
+			wantDecided: false,
+		},
+		{
+			name:        "hostname rule before the address rule",
+			rules:       "deny *.corp\nallow 10.0.0.0/8\ndeny *",
+			req:         Request{FQDN: "intranet.corp", Port: 443},
+			wantLine:    1,
+			wantDecided: true,
+		},
+		{
+			name:        "address rule for other ports",
+			rules:       "allow 10.0.0.0/8 22\ndeny *",
+			req:         Request{FQDN: "intranet.corp", Port: 443},
+			wantLine:    2,
+			wantDecided: true,
+		},
+		{
+			name:        "address rule for another user",
+			rules:       "allow user=bob 10.0.0.0/8\ndeny *",
+			req:         Request{User: "alice", FQDN: "intranet.corp", Port: 443},
+			wantLine:    2,
+			wantDecided: true,
+		},
+		{
+			name:        "no rule",
+			rules:       "deny 10.0.0.0/8",
+			req:         Request{FQDN: "example.com", IP: net.ParseIP("192.0.2.1"), Port: 80},
+			wantDecided: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := mustParse(t, tt.rules)
+			for _, decide := range []struct {
+				name string
+				f    func(Request) (*Rule, bool)
+			}{{"Decide", l.Decide}, {"MatchAnyAgent", l.MatchAnyAgent}} {
+				rule, decided := decide.f(tt.req)
+				line := 0
+				if rule != nil {
+					line = rule.Line
+				}
+				if decided != tt.wantDecided || line != tt.wantLine {
+					t.Errorf("%s = line %d, %v; want line %d, %v", decide.name, line, decided, tt.wantLine, tt.wantDecided)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchAnyAgent(t *testing.T) {
+	l := mustParse(t, "deny agent=lab 10.0.0.0/8\nallow *")
+	req := Request{Agent: "office", IP: net.ParseIP("10.1.2.3"), Port: 443}
+
+	if rule, decided := l.MatchAnyAgent(req); decided {
+		t.Errorf("MatchAnyAgent decided by %v, want it left to the agent", rule)
+	}
+	if rule, decided := l.Decide(req); !decided || rule == nil || rule.Line != 2 {
+		t.Errorf("Decide = %v, %v; want line 2", rule, decided)
+	}
+}
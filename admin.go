@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Acebond/ReverseSocks5/mux"
+)
+
+// The admin API is a small REST/JSON interface to a running server. Without a
+// token it only listens on, and only answers, loopback addresses. With a token
+// every request must carry it as "Authorization: Bearer <token>". Requests
+// other than GET must have a Content-Type of application/json.
+//
+//	GET    /agents                      connected agents
+//	DELETE /agents/{id}                 disconnect an agent
+//	GET    /streams                     open streams on every agent
+//	DELETE /streams/{agent}/{id}        close a stream and its client
+//	GET    /listeners                   open listeners
+//	POST   /listeners                   open a listener, {"kind": ..., "address": ...}
+//	DELETE /listeners/{kind}/{address}  close a listener
+//	POST   /reload                      reload the configuration
+//
+// Listeners opened or closed through the API are put back in line with the
+// configuration by the next reload.
+
+// A streamInfo describes what a stream on an agent's mux is carrying.
+type streamInfo struct {
+	// "socks", "socks4", "udp", "http", "forward", "rforward", or
+	// "rforward-listen" for the stream holding a reverse forward open
+	Kind   string
+	User   string
+	Source string
+	Dest   string
+
+	// the connection on the server the stream is tunnelled to, if any
+	client io.Closer
+	// the reply the server sent itself, for requests the agent did not answer
+	reply *uint8
+}
+
+// setStreamInfo records info on stream, for the admin API to show.
+func setStreamInfo(stream net.Conn, info *streamInfo) {
+	if s, ok := stream.(*mux.Stream); ok {
+		s.SetInfo(info)
+	}
+}
+
+type agentStatus struct {
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Uptime      float64   `json:"uptime_seconds"`
+	Streams     int       `json:"streams"`
+}
+
+type streamStatus struct {
+	Agent  uint64 `json:"agent"`
+	ID     uint32 `json:"id"`
+	Kind   string `json:"kind"`
+	User   string `json:"user,omitempty"`
+	Source string `json:"source,omitempty"`
+	Dest   string `json:"destination,omitempty"`
+	// bytes sent to and received from the agent
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	OpenedAt      time.Time `json:"opened_at"`
+	Age           float64   `json:"age_seconds"`
+}
+
+type listenerStatus struct {
+	Kind    string `json:"kind"`
+	Address string `json:"address"`
+}
+
+// newAdminHandler returns the handler for the admin API of s.
+func newAdminHandler(s *reverseServer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents", s.adminAgents)
+	mux.HandleFunc("DELETE /agents/{id}", s.adminDisconnectAgent)
+	mux.HandleFunc("GET /streams", s.adminStreams)
+	mux.HandleFunc("DELETE /streams/{agent}/{id}", s.adminCloseStream)
+	mux.HandleFunc("GET /listeners", s.adminListeners)
+	mux.HandleFunc("POST /listeners", s.adminOpenListener)
+	mux.HandleFunc("DELETE /listeners/{kind}/{address}", s.adminCloseListener)
+	mux.HandleFunc("POST /reload", s.adminReload)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, err := s.adminSameSite(r); err != nil {
+			slog.Warn("Refused admin request", "method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr, "err", err)
+			writeError(w, status, err)
+			return
+		}
+		if !s.adminAuthorized(r) {
+			slog.Warn("Refused admin request", "method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ReverseSocks5"`)
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized checks the request's bearer token, or that it comes from a
+// loopback address if no token is configured.
+func (s *reverseServer) adminAuthorized(r *http.Request) bool {
+	token := s.settings().config.AdminToken
+	if token == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		return err == nil && isLoopback(host)
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// adminSameSite guards the admin API against web pages open in a browser on
+// the same machine. The Host must be the admin listen address, an IP address
+// or a loopback name, none of which a DNS rebinding attack can use, and
+// requests that change anything must be JSON, which a page cannot send to
+// another site without a CORS preflight that the API never answers.
+func (s *reverseServer) adminSameSite(r *http.Request) (int, error) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	listenHost, _, _ := net.SplitHostPort(s.settings().config.AdminListen)
+	if host != strings.ToLower(listenHost) && net.ParseIP(host) == nil &&
+		!isLoopback(host) && !strings.HasSuffix(host, ".localhost") {
+		return http.StatusForbidden, fmt.Errorf("host %q is not the admin API's", r.Host)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			return http.StatusUnsupportedMediaType, errors.New("requests that change anything must have a Content-Type of application/json")
+		}
+	}
+	return 0, nil
+}
+
+// isLoopback reports whether host is a loopback address or localhost.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveAdmin serves the admin API until ln is closed.
+func (s *reverseServer) serveAdmin(ln net.Listener) {
+	slog.Info("Listening for admin requests", "listen", ln.Addr().String())
+	http.Serve(ln, s.admin) //nolint: errcheck
+}
+
+func (s *reverseServer) adminAgents(w http.ResponseWriter, r *http.Request) {
+	list := []agentStatus{}
+	for _, a := range s.agents.list() {
+		list = append(list, agentStatus{
+			ID:          a.ID,
+			Name:        a.Name,
+			RemoteAddr:  a.RemoteAddr.String(),
+			ConnectedAt: a.ConnectedAt,
+			Uptime:      time.Since(a.ConnectedAt).Seconds(),
+			Streams:     len(a.session.Streams()),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *reverseServer) adminDisconnectAgent(w http.ResponseWriter, r *http.Request) {
+	a, err := s.adminAgent(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	a.log.Info("Disconnecting agent through the admin API")
+	a.session.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *reverseServer) adminStreams(w http.ResponseWriter, r *http.Request) {
+	list := []streamStatus{}
+	for _, a := range s.agents.list() {
+		for _, stream := range a.session.Streams() {
+			status := streamStatus{
+				Agent:         a.ID,
+				ID:            stream.ID(),
+				BytesSent:     stream.BytesWritten(),
+				BytesReceived: stream.BytesRead(),
+				OpenedAt:      stream.Opened(),
+				Age:           time.Since(stream.Opened()).Seconds(),
+			}
+			if info, ok := stream.Info().(*streamInfo); ok {
+				status.Kind, status.User, status.Source, status.Dest = info.Kind, info.User, info.Source, info.Dest
+			}
+			list = append(list, status)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *reverseServer) adminCloseStream(w http.ResponseWriter, r *http.Request) {
+	a, err := s.adminAgent(r.PathValue("agent"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad stream id %q", r.PathValue("id")))
+		return
+	}
+	for _, stream := range a.session.Streams() {
+		if stream.ID() != uint32(id) {
+			continue
+		}
+		a.log.Info("Closing stream through the admin API", "stream", id)
+		if info, ok := stream.Info().(*streamInfo); ok && info.client != nil {
+			info.client.Close()
+		}
+		stream.Close()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("agent %d has no stream %d", a.ID, id))
+}
+
+// adminAgent returns the connected agent with the given ID.
+func (s *reverseServer) adminAgent(id string) (*Agent, error) {
+	for _, a := range s.agents.list() {
+		if strconv.FormatUint(a.ID, 10) == id {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no agent %q", id)
+}
+
+func (s *reverseServer) adminListeners(w http.ResponseWriter, r *http.Request) {
+	list := []listenerStatus{}
+	for _, l := range s.listenerList() {
+		list = append(list, listenerStatus{l.Kind, l.Address})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *reverseServer) adminOpenListener(w http.ResponseWriter, r *http.Request) {
+	var req listenerStatus
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	l, err := s.openListener(req.Kind, req.Address)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	slog.Info("Opened listener through the admin API", "kind", l.Kind, "listen", l.Address)
+	writeJSON(w, http.StatusCreated, listenerStatus{l.Kind, l.Address})
+}
+
+func (s *reverseServer) adminCloseListener(w http.ResponseWriter, r *http.Request) {
+	kind, address := r.PathValue("kind"), r.PathValue("address")
+	if err := s.closeListener(kind, address); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	slog.Info("Closed listener through the admin API", "kind", kind, "listen", address)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *reverseServer) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.reload(); err != nil {
+		slog.Error("Failed to reload the configuration", "err", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v) //nolint: errcheck
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
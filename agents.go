@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Acebond/ReverseSocks5/mux"
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// An Agent is a socks agent connected to the server.
+type Agent struct {
+	ID          uint64
+	Name        string
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+	session     *mux.Mux
+	log         *slog.Logger // with the agent's ID and name
+
+	// the streams carrying the agent's reverse forwards, by rule
+	mu              sync.Mutex
+	reverseForwards map[string]net.Conn
+}
+
+// Alive reports whether the agent's mux is still running.
+func (a *Agent) Alive() bool {
+	select {
+	case <-a.session.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// withStream adds the agent and the stream a client is served on to logger.
+func withStream(logger *slog.Logger, a *Agent, stream net.Conn) *slog.Logger {
+	args := []any{"agent", a.ID}
+	if s, ok := stream.(*mux.Stream); ok {
+		args = append(args, "stream", s.ID())
+	}
+	return logger.With(args...)
+}
+
+// errNoAgent is returned when no agent is available to open a stream on.
+var errNoAgent = errors.New("no agent available")
+
+// A replyError is returned when an agent answers a request with a failure.
+type replyError struct {
+	Dest  statute.AddrSpec
+	Reply uint8
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("connect to %v failed, reply %d", e.Dest.String(), e.Reply)
+}
+
+// agentRegistry tracks the agents currently connected to the server.
+type agentRegistry struct {
+	mu sync.Mutex
+	// how long openStream waits for an agent when none is connected
+	waitTimeout time.Duration
+
+	nextID  uint64
+	agents  map[uint64]*Agent
+	changed chan struct{} // closed and replaced whenever an agent is added
+}
+
+func newAgentRegistry(waitTimeout time.Duration) *agentRegistry {
+	return &agentRegistry{
+		waitTimeout: waitTimeout,
+		nextID:      1,
+		agents:      make(map[uint64]*Agent),
+		changed:     make(chan struct{}),
+	}
+}
+
+// add registers a new agent and removes it again once its mux shuts down.
+// The agent's logger adds its ID and name to logger.
+func (r *agentRegistry) add(name string, remoteAddr net.Addr, session *mux.Mux, logger *slog.Logger) *Agent {
+	r.mu.Lock()
+	a := &Agent{
+		ID:          r.nextID,
+		Name:        name,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: time.Now(),
+		session:     session,
+		log:         logger.With("agent", r.nextID, "agent_name", name),
+
+		reverseForwards: make(map[string]net.Conn),
+	}
+	r.agents[a.ID] = a
+	r.nextID++
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+
+	go func() {
+		<-session.Done()
+		r.remove(a)
+	}()
+	return a
+}
+
+func (r *agentRegistry) setWaitTimeout(waitTimeout time.Duration) {
+	r.mu.Lock()
+	r.waitTimeout = waitTimeout
+	r.mu.Unlock()
+}
+
+func (r *agentRegistry) remove(a *Agent) {
+	r.mu.Lock()
+	delete(r.agents, a.ID)
+	r.mu.Unlock()
+}
+
+// list returns the connected agents ordered by ID.
+func (r *agentRegistry) list() []*Agent {
+	r.mu.Lock()
+	agents := make([]*Agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		agents = append(agents, a)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+// pick returns the most recently connected agent that is still alive, or nil
+// if there is none.
+func (r *agentRegistry) pick() *Agent {
+	agents := r.list()
+	for i := len(agents) - 1; i >= 0; i-- {
+		if agents[i].Alive() {
+			return agents[i]
+		}
+	}
+	return nil
+}
+
+// get returns the most recently connected live agent with the given name or
+// ID, or nil if there is none.
+func (r *agentRegistry) get(name string) *Agent {
+	agents := r.list()
+	for i := len(agents) - 1; i >= 0; i-- {
+		a := agents[i]
+		if (a.Name == name || strconv.FormatUint(a.ID, 10) == name) && a.Alive() {
+			return a
+		}
+	}
+	return nil
+}
+
+// wait returns the agent with the given name, or the default agent if name is
+// empty, waiting up to r.waitTimeout for it to connect. It returns nil if
+// there is still no such agent once the time is up.
+func (r *agentRegistry) wait(name string) *Agent {
+	r.mu.Lock()
+	timer := time.NewTimer(r.waitTimeout)
+	r.mu.Unlock()
+	defer timer.Stop()
+
+	for {
+		// grab changed before looking, so an agent added in between is not missed
+		r.mu.Lock()
+		changed := r.changed
+		r.mu.Unlock()
+
+		var a *Agent
+		if name != "" {
+			a = r.get(name)
+		} else {
+			a = r.pick()
+		}
+		if a != nil {
+			return a
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// openStream opens a new stream on the agent with the given name, or the
+// default agent if name is empty. Agents that go away in the meantime are
+// skipped.
+func (r *agentRegistry) openStream(name string) (net.Conn, *Agent, error) {
+	for {
+		a := r.wait(name)
+		if a == nil {
+			metrics.streamFailures.add("no_agent", 1)
+			return nil, nil, errNoAgent
+		}
+		stream, err := a.session.OpenStream()
+		if err == nil {
+			return stream, a, nil
+		}
+		// The agent is going away, wait on its mux so it is not picked again.
+		<-a.session.Done()
+	}
+}
+
+// connect asks the agent with the given name, or the default agent if name is
+// empty, to connect to dest on behalf of a client that does not speak SOCKS
+// itself. The agent's reply is returned, and the stream is only returned if
+// the connection succeeded. If allow is not nil, it is asked whether the agent
+// may be used for dest before the request is sent on the stream, and a rule
+// failure is returned if not.
+func (r *agentRegistry) connect(name string, dest statute.AddrSpec, allow func(*Agent, net.Conn) bool) (net.Conn, statute.Reply, error) {
+	stream, a, err := r.openStream(name)
+	if err != nil {
+		return nil, statute.Reply{}, err
+	}
+	if allow != nil && !allow(a, stream) {
+		stream.Close()
+		rep := statute.Reply{Version: statute.VersionSocks5, Response: statute.RepRuleFailure}
+		return nil, rep, &replyError{dest, rep.Response}
+	}
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: dest,
+	}
+	if _, err := stream.Write(req.Bytes()); err != nil {
+		stream.Close()
+		return nil, statute.Reply{}, err
+	}
+	rep, err := statute.ParseReply(stream)
+	if err != nil {
+		stream.Close()
+		return nil, rep, err
+	}
+	if rep.Response != statute.RepSuccess {
+		stream.Close()
+		return nil, rep, &replyError{dest, rep.Response}
+	}
+	return stream, rep, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync/atomic"
+
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// UDP datagrams are carried over a stream as a 2 byte big endian length
+// followed by the SOCKS UDP request header and data, see statute.Datagram.
+
+// writeDatagram writes a single length prefixed datagram to w.
+func writeDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > math.MaxUint16 {
+		return fmt.Errorf("datagram too large (%d bytes)", len(datagram))
+	}
+	buf := make([]byte, 2, 2+len(datagram))
+	binary.BigEndian.PutUint16(buf, uint16(len(datagram)))
+	_, err := w.Write(append(buf, datagram...))
+	return err
+}
+
+// readDatagram reads a single length prefixed datagram from r into buf,
+// which must have a capacity of at least math.MaxUint16 bytes.
+func readDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// handleSocksAssociate serves a UDP ASSOCIATE request on the server. The UDP
+// socket the client talks to is bound here, and datagrams are relayed to the
+// agent over the stream for as long as the client keeps the TCP connection
+// open. Datagrams to destinations allow rejects are dropped.
+func handleSocksAssociate(conn net.Conn, reader io.Reader, stream net.Conn, request statute.Request, allow func(statute.AddrSpec) bool, logger *slog.Logger) error {
+
+	// Bind on the same IP the client reached us on, so the address in the
+	// reply is one the client can send to.
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	bindAddr := &net.UDPAddr{}
+	if local != nil {
+		bindAddr.IP, bindAddr.Zone = local.IP, local.Zone
+	}
+	bindLn, err := net.ListenUDP("udp", bindAddr)
+	if err != nil {
+		if err := SendReply(conn, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen udp failed, %v", err)
+	}
+	defer bindLn.Close()
+
+	// Let the agent know about the association and wait for it to accept.
+	if _, err := stream.Write(request.Bytes()); err != nil {
+		return fmt.Errorf("failed to forward request, %v", err)
+	}
+	rep, err := statute.ParseReply(stream)
+	if err != nil {
+		return fmt.Errorf("failed to read reply, %v", err)
+	}
+	if rep.Response != statute.RepSuccess {
+		if err := SendReply(conn, rep.Response, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("agent refused udp associate, reply %d", rep.Response)
+	}
+
+	// send BND.ADDR and BND.PORT, client used
+	if err := SendReply(conn, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	// clientAddr is learnt from the first datagram the client sends
+	var clientAddr atomic.Pointer[net.UDPAddr]
+
+	// read from agent and write to client
+	go func() {
+		// the agent closing the stream ends the association
+		defer conn.Close()
+		buf := bufferPool.Get()
+		defer bufferPool.Put(buf)
+		for {
+			datagram, err := readDatagram(stream, buf[:cap(buf)])
+			if err != nil {
+				return
+			}
+			srcAddr := clientAddr.Load()
+			if srcAddr == nil {
+				continue
+			}
+			if _, err := bindLn.WriteToUDP(datagram, srcAddr); err != nil {
+				logger.Warn("Failed to write a datagram to the client", "client_udp", srcAddr.String(), "err", err)
+				return
+			}
+		}
+	}()
+
+	// read from client and write to agent
+	go func() {
+		buf := bufferPool.Get()
+		defer bufferPool.Put(buf)
+		for {
+			n, srcAddr, err := bindLn.ReadFromUDP(buf[:cap(buf)])
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+
+			// check src addr whether equal request.DstAddr
+			dst := request.DstAddr
+			srcEqual := (len(dst.IP) == 0 || dst.IP.IsUnspecified() || dst.IP.Equal(srcAddr.IP)) && (dst.Port == 0 || dst.Port == srcAddr.Port) //nolint:lll
+			if !srcEqual {
+				continue
+			}
+			// once the client is known, ignore anyone else
+			if known := clientAddr.Load(); known != nil && (!known.IP.Equal(srcAddr.IP) || known.Port != srcAddr.Port) {
+				continue
+			}
+
+			pk, err := statute.ParseDatagram(buf[:n])
+			if err != nil || pk.Frag != 0 {
+				// fragmentation is not supported, drop the datagram
+				continue
+			}
+			if !allow(pk.DstAddr) {
+				continue
+			}
+
+			clientAddr.Store(srcAddr)
+			if err := writeDatagram(stream, buf[:n]); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// The association terminates when the TCP connection closes.
+	buf := bufferPool.Get()
+	defer bufferPool.Put(buf)
+	io.CopyBuffer(io.Discard, reader, buf[:cap(buf)]) //nolint: errcheck
+	return nil
+}
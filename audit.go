@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Acebond/ReverseSocks5/mux"
+)
+
+// The audit log has a JSON object on each line for every connection tunnelled
+// through an agent, written when its stream closes. When chained, each record
+// holds the SHA-256 of the line before it as prev_hash, so that a record that
+// is changed or removed breaks the chain.
+
+// A streamReport is what the agent tells the server about a request, out of
+// band on the request's stream.
+type streamReport struct {
+	Reply    uint8  `json:"reply"`
+	Resolved string `json:"resolved,omitempty"` // the IP the destination resolved to
+}
+
+// sendStreamReport reports rep on stream, if it is a mux stream.
+func sendStreamReport(stream io.Writer, rep streamReport) error {
+	s, ok := stream.(*mux.Stream)
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	return s.SendReport(b)
+}
+
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	User     string    `json:"user,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	AgentID  uint64    `json:"agent_id"`
+	Agent    string    `json:"agent"`
+	Stream   uint32    `json:"stream"`
+	Dest     string    `json:"destination,omitempty"`
+	Resolved string    `json:"resolved,omitempty"`
+	Reply    *uint8    `json:"reply,omitempty"`
+	Duration float64   `json:"duration_seconds"`
+	// bytes sent to and received from the agent
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+	PrevHash      string `json:"prev_hash,omitempty"`
+}
+
+// newAuditRecord describes a stream of agent that has closed. It returns nil
+// for streams that are not worth recording.
+func newAuditRecord(agent *Agent, stream *mux.Stream) *auditRecord {
+	info, ok := stream.Info().(*streamInfo)
+	if !ok || info.Kind == "rforward-listen" {
+		return nil
+	}
+	rec := &auditRecord{
+		Time:          time.Now().UTC(),
+		Kind:          info.Kind,
+		User:          info.User,
+		Source:        info.Source,
+		AgentID:       agent.ID,
+		Agent:         agent.Name,
+		Stream:        stream.ID(),
+		Dest:          info.Dest,
+		Reply:         info.reply,
+		Duration:      time.Since(stream.Opened()).Seconds(),
+		BytesSent:     stream.BytesWritten(),
+		BytesReceived: stream.BytesRead(),
+	}
+	var report streamReport
+	if json.Unmarshal(stream.Report(), &report) == nil {
+		rec.Reply, rec.Resolved = &report.Reply, report.Resolved
+	}
+	return rec
+}
+
+// auditStream records a stream of agent that has closed in the audit log.
+// It runs in the mux's read loop, so it only queues the record.
+func (s *reverseServer) auditStream(agent *Agent, stream *mux.Stream) {
+	if rec := newAuditRecord(agent, stream); rec != nil {
+		s.audit.queue(rec, agent.log)
+	}
+}
+
+// auditQueueSize bounds the records waiting to be written.
+const auditQueueSize = 4096
+
+// An auditLog appends records to a file. Records are queued and written in
+// order by a goroutine of their own, so that a slow disk does not hold up the
+// agents' connections. The zero value writes nothing until it is opened.
+type auditLog struct {
+	start   sync.Once
+	records chan queuedRecord
+
+	mu    sync.Mutex
+	path  string
+	chain bool
+	f     *os.File
+	prev  []byte // hash of the last line written, if chained
+}
+
+// A queuedRecord is a record waiting to be written, and where to log the
+// failure to write it.
+type queuedRecord struct {
+	rec *auditRecord
+	log *slog.Logger
+}
+
+// queue hands rec to the writer. If the writer has fallen too far behind,
+// rec is dropped rather than wait for it.
+func (l *auditLog) queue(rec *auditRecord, logger *slog.Logger) {
+	l.start.Do(func() {
+		l.records = make(chan queuedRecord, auditQueueSize)
+		go l.writeLoop()
+	})
+	select {
+	case l.records <- queuedRecord{rec, logger}:
+	default:
+		logger.Warn("Dropped an audit record, the audit log is not keeping up", "stream", rec.Stream, "destination", rec.Dest)
+	}
+}
+
+// writeLoop writes the queued records.
+func (l *auditLog) writeLoop() {
+	for q := range l.records {
+		if err := l.write(q.rec); err != nil {
+			q.log.Warn("Failed to write to the audit log", "err", err)
+		}
+	}
+}
+
+// open switches to appending to path, or to writing nothing if path is empty.
+// A chain carries on from the last line of the file, or from the last record
+// written if the file is new and has the same path, as after rotating it.
+func (l *auditLog) open(path string, chain bool) error {
+	var f *os.File
+	if path != "" {
+		var err error
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the last line is read with the lock held, so that no record is written
+	// after it
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var prev []byte
+	if chain && f != nil {
+		if l.chain && sameFile(f, l.f) {
+			prev = l.prev
+		} else {
+			var err error
+			if prev, err = lastLineHash(path); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if prev == nil && path == l.path {
+		prev = l.prev
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.path, l.chain, l.f, l.prev = path, chain, f, prev
+	return nil
+}
+
+// sameFile reports whether a and b are open on the same file.
+func sameFile(a, b *os.File) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	ai, err := a.Stat()
+	if err != nil {
+		return false
+	}
+	bi, err := b.Stat()
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// write appends rec to the log.
+func (l *auditLog) write(rec *auditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+
+	if l.chain && l.prev != nil {
+		rec.PrevHash = hex.EncodeToString(l.prev)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if l.chain {
+		sum := sha256.Sum256(line)
+		l.prev = sum[:]
+	}
+	_, err = l.f.Write(append(line, '\n'))
+	return err
+}
+
+// lastLineHash returns the SHA-256 of the last line of the file at path, or
+// nil if it is empty.
+func lastLineHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// records are far smaller than this
+	const tail = 64 << 10
+	offset := max(info.Size()-tail, 0)
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	sum := sha256.Sum256(buf[bytes.LastIndexByte(buf, '\n')+1:])
+	return sum[:], nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForRecords waits for the n records queued to be written to the log at
+// path, and returns its lines.
+func waitForRecords(t *testing.T, path string, n int) [][]byte {
+	t.Helper()
+	var lines [][]byte
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+		if len(lines) == n || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(lines) != n {
+		t.Fatalf("%d records written, want %d", len(lines), n)
+	}
+	return lines
+}
+
+func TestAuditLogQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var l auditLog
+	if err := l.open(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	for i := range n {
+		l.queue(&auditRecord{Kind: "socks5", Stream: uint32(i)}, slog.Default())
+	}
+
+	lines := waitForRecords(t, path, n)
+
+	var prev string
+	for i, line := range lines {
+		var rec auditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if rec.Stream != uint32(i) {
+			t.Errorf("record %d is of stream %d, records were reordered", i, rec.Stream)
+		}
+		if rec.PrevHash != prev {
+			t.Errorf("record %d has prev_hash %q, want %q", i, rec.PrevHash, prev)
+		}
+		sum := sha256.Sum256(line)
+		prev = hex.EncodeToString(sum[:])
+	}
+}
+
+// TestAuditLogReopen reopens the log, as a SIGHUP does, while records are
+// being written, which must not break the chain.
+func TestAuditLogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var l auditLog
+	if err := l.open(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range n {
+			l.queue(&auditRecord{Kind: "socks5", Stream: uint32(i)}, slog.Default())
+			if i%64 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	for reopened := false; !reopened; {
+		select {
+		case <-done:
+			reopened = true
+		default:
+			if err := l.open(path, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	lines := waitForRecords(t, path, n)
+	var prev string
+	for i, line := range lines {
+		var rec auditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if rec.PrevHash != prev {
+			t.Fatalf("record %d has prev_hash %q, want %q", i, rec.PrevHash, prev)
+		}
+		sum := sha256.Sum256(line)
+		prev = hex.EncodeToString(sum[:])
+	}
+}
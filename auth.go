@@ -1,7 +1,9 @@
 package main
 
 import (
-	"net"
+	"fmt"
+	"io"
+	"strings"
 
 	"github.com/Acebond/ReverseSocks5/statute"
 )
@@ -13,13 +15,13 @@ type AuthContext struct {
 	Method uint8
 	// Payload provided during negotiation.
 	// Keys depend on the used auth method.
-	// For UserPass auth contains username/password
-	// Payload map[string]string
+	// For UserPass auth contains username and agent
+	Payload map[string]string
 }
 
 // Authenticator provide auth
 type Authenticator interface {
-	Authenticate(conn net.Conn) error
+	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
 	GetCode() uint8
 }
 
@@ -30,45 +32,75 @@ type NoAuthAuthenticator struct{}
 func (a NoAuthAuthenticator) GetCode() uint8 { return statute.MethodNoAuth }
 
 // Authenticate implement interface Authenticator
-func (a NoAuthAuthenticator) Authenticate(conn net.Conn) error {
-	_, err := conn.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth})
-	return err
+func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	_, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth})
+	return &AuthContext{statute.MethodNoAuth, make(map[string]string)}, err
 }
 
 // UserPassAuthenticator is used to handle username/password based
-// authentication
+// authentication. The username may name the agent to tunnel through, as
+// either "user@agent" or just "agent" for the user with an empty name.
 type UserPassAuthenticator struct {
-	Username string
-	Password string
+	Credentials CredentialStore
 }
 
 // GetCode implement interface Authenticator
 func (a UserPassAuthenticator) GetCode() uint8 { return statute.MethodUserPassAuth }
 
 // Authenticate implement interface Authenticator
-func (a UserPassAuthenticator) Authenticate(conn net.Conn) error {
+func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 
 	// reply the client to use user/pass auth
-	if _, err := conn.Write([]byte{statute.VersionSocks5, statute.MethodUserPassAuth}); err != nil {
-		return err
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodUserPassAuth}); err != nil {
+		return nil, err
 	}
 
 	// get user and user's password
-	nup, err := statute.ParseUserPassRequest(conn)
+	nup, err := statute.ParseUserPassRequest(reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Verify the password
-	if a.Username == string(nup.User) && a.Password == string(nup.Pass) {
-		if _, err = conn.Write([]byte{statute.UserPassAuthVersion, statute.AuthSuccess}); err != nil {
-			return err
+	if user, agent, ok := a.Valid(string(nup.User), string(nup.Pass)); ok {
+		if _, err = writer.Write([]byte{statute.UserPassAuthVersion, statute.AuthSuccess}); err != nil {
+			return nil, err
 		}
-		return nil
+		return &AuthContext{
+			statute.MethodUserPassAuth,
+			map[string]string{
+				"username": user,
+				"agent":    agent,
+			},
+		}, nil
 	}
 
-	if _, err := conn.Write([]byte{statute.UserPassAuthVersion, statute.AuthFailure}); err != nil {
-		return err
+	if _, err := writer.Write([]byte{statute.UserPassAuthVersion, statute.AuthFailure}); err != nil {
+		return nil, err
 	}
-	return statute.ErrUserAuthFailed
+	return nil, fmt.Errorf("%w for %q", statute.ErrUserAuthFailed, nup.User)
+}
+
+// Valid checks a username and password, and returns the user and the agent
+// the username names. A user whose name has an "@" in it takes precedence
+// over the username being split into a user and an agent.
+func (a UserPassAuthenticator) Valid(username, password string) (user, agent string, ok bool) {
+	splitUser, splitAgent := splitUsername(username)
+	user, ok = a.Credentials.Valid(password, username, splitUser)
+	if !ok {
+		return "", "", false
+	}
+	if user == username {
+		return user, "", true
+	}
+	return splitUser, splitAgent, true
+}
+
+// splitUsername splits a SOCKS username of the form "user@agent". A username
+// without an "@" names an agent.
+func splitUsername(username string) (user, agent string) {
+	if i := strings.LastIndexByte(username, '@'); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+	return "", username
 }
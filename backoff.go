@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff controls how the agent waits between attempts to reconnect to the
+// server. Consecutive failures double the delay, starting at Min and capped at
+// Max, and a Jitter fraction of each delay is randomised so that agents cut off
+// at the same time do not all reconnect at once.
+type Backoff struct {
+	Min      time.Duration
+	Max      time.Duration
+	Jitter   float64
+	Attempts int           // give up after this many consecutive failures, 0 for no limit
+	Deadline time.Duration // give up after this long without a connection, 0 for no limit
+}
+
+// delay returns how long to wait before the given retry, counting from 1.
+func (b Backoff) delay(attempt int) time.Duration {
+	d := b.Min
+	for i := 1; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	d = min(d, b.Max)
+
+	if b.Jitter > 0 {
+		jitter := time.Duration(float64(d) * min(b.Jitter, 1))
+		d += time.Duration(rand.Int64N(int64(2*jitter)+1)) - jitter
+	}
+	return max(d, 0)
+}
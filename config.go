@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A configuration file is a JSON object whose keys are the names of command
+// line flags, for example
+//
+//	{
+//		"socks": "127.0.0.1:1080",
+//		"acl": "/etc/reversesocks5/acl.txt",
+//		"agent-wait": "30s",
+//		"forward": ["127.0.0.1:3389=10.0.0.5:3389"]
+//	}
+//
+// Values are strings, numbers or booleans, and flags that may be given more
+// than once also take an array. Flags given on the command line override the
+// file, for repeatable flags the file's values are then ignored.
+
+// A repeatableFlag is a flag that may be given more than once.
+type repeatableFlag interface {
+	flag.Value
+	repeatable()
+}
+
+// loadConfigFile sets the flags in fs named by the keys of the configuration
+// file at path, except for those already set on the command line. Errors give
+// the line and column in the file they refer to.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	errorAt := func(offset int64, format string, args ...any) error {
+		line, col := position(data, offset)
+		return fmt.Errorf("%s:%d:%d: %s", path, line, col, fmt.Sprintf(format, args...))
+	}
+	jsonError := func(err error) error {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return errorAt(syntaxErr.Offset, "%v", err)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return errorAt(int64(len(data)), "unexpected end of file")
+		}
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return jsonError(err)
+	} else if tok != json.Delim('{') {
+		return errorAt(skipSpace(data, 0), "configuration must be a JSON object")
+	}
+
+	seen := make(map[string]bool)
+	for dec.More() {
+		keyOffset := skipSpace(data, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return jsonError(err)
+		}
+		key := tok.(string)
+		valueOffset := skipSpace(data, dec.InputOffset())
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return jsonError(err)
+		}
+
+		f := fs.Lookup(key)
+		if f == nil || key == "config" || key == "check-config" {
+			return errorAt(keyOffset, "unknown option %q", key)
+		}
+		if seen[key] {
+			return errorAt(keyOffset, "duplicate option %q", key)
+		}
+		seen[key] = true
+		if setOnCommandLine[key] {
+			continue
+		}
+
+		// set every element of an array in turn
+		elements := []json.RawMessage{value}
+		offsets := []int64{valueOffset}
+		if value[0] == '[' {
+			if _, ok := f.Value.(repeatableFlag); !ok {
+				return errorAt(valueOffset, "option %q takes a single value", key)
+			}
+			elements, offsets = elements[:0], offsets[:0]
+			elemDec := json.NewDecoder(bytes.NewReader(value))
+			elemDec.UseNumber()
+			elemDec.Token() //nolint: errcheck
+			for elemDec.More() {
+				var elem json.RawMessage
+				offset := valueOffset + skipSpace(value, elemDec.InputOffset())
+				if err := elemDec.Decode(&elem); err != nil {
+					return jsonError(err)
+				}
+				elements, offsets = append(elements, elem), append(offsets, offset)
+			}
+		}
+
+		for i, elem := range elements {
+			s, err := flagString(elem)
+			if err != nil {
+				return errorAt(offsets[i], "option %q %v", key, err)
+			}
+			if err := f.Value.Set(s); err != nil {
+				return errorAt(offsets[i], "invalid value %q for option %q: %v", s, key, err)
+			}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return jsonError(err)
+	}
+	if dec.More() {
+		return errorAt(skipSpace(data, dec.InputOffset()), "unexpected data after the configuration")
+	}
+	return nil
+}
+
+// flagString converts a JSON string, number or boolean to the string passed
+// to flag.Value.Set.
+func flagString(value json.RawMessage) (string, error) {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", errors.New("must be a string, number or boolean")
+}
+
+// skipSpace returns the offset of the next JSON token in data at or after
+// offset, skipping white space and the separators the decoder leaves behind.
+func skipSpace(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// position returns the 1-based line and column of offset in data.
+func position(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = int(offset) - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	return line, col
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A CredentialStore checks the passwords of SOCKS and HTTP proxy users.
+type CredentialStore interface {
+	// Valid reports whether password is the password of the first of users
+	// that exists, and which user that is. It takes about as long whether or
+	// not any of them exist.
+	Valid(password string, users ...string) (user string, ok bool)
+}
+
+// staticCredentials is the single user given on the command line.
+type staticCredentials struct {
+	username string
+	password string
+}
+
+func (c staticCredentials) Valid(password string, users ...string) (string, bool) {
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.password))
+	for _, user := range users {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(c.username))&passOK == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// credentialsFile holds users loaded from an htpasswd style file of
+// "user:hash" lines, where hash is a bcrypt ($2a$, $2b$ or $2y$) or an
+// argon2id ($argon2id$) hash. Blank lines and lines starting with '#' are
+// ignored.
+type credentialsFile struct {
+	path  string
+	users map[string]passwordHash
+
+	// checked against for unknown users, so they take as long as known ones
+	dummy passwordHash
+
+	// passwords that have been verified, so that a client sending its
+	// credentials with every request only pays for hashing once
+	cacheKey []byte
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// verifiedCacheSize bounds the passwords remembered as verified.
+const verifiedCacheSize = 1024
+
+// hashSlots bounds the password hashes computed at once, so that a flood of
+// logins cannot take more than this many times the memory of a hash.
+var hashSlots = make(chan struct{}, runtime.NumCPU())
+
+// A passwordHash verifies a password against a stored hash.
+type passwordHash interface {
+	verify(password string) bool
+	// dummy returns a hash of the same scheme and cost, for a password that
+	// is never used
+	dummy() (passwordHash, error)
+}
+
+func newCredentialsFile(path string) (*credentialsFile, error) {
+	c := &credentialsFile{
+		path:     path,
+		cacheKey: make([]byte, 32),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+	rand.Read(c.cacheKey)
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the users from the file. Unknown users are checked against a
+// dummy like the hash of the first user.
+func (c *credentialsFile) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.users = make(map[string]passwordHash)
+	var first passwordHash
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s:%d: expected user:hash", c.path, lineNo)
+		}
+		h, err := parsePasswordHash(hash)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", c.path, lineNo, err)
+		}
+		if _, dup := c.users[user]; dup {
+			return fmt.Errorf("%s:%d: duplicate user %q", c.path, lineNo, user)
+		}
+		c.users[user] = h
+		if first == nil {
+			first = h
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if first == nil {
+		c.dummy, err = newBcryptDummy(bcrypt.DefaultCost)
+		return err
+	}
+	c.dummy, err = first.dummy()
+	return err
+}
+
+func (c *credentialsFile) Valid(password string, users ...string) (string, bool) {
+	// look for every user whatever is found, and check a single hash
+	h, user, found := c.dummy, "", false
+	for i := len(users) - 1; i >= 0; i-- {
+		if uh, ok := c.users[users[i]]; ok {
+			h, user, found = uh, users[i], true
+		}
+	}
+
+	mac := hmac.New(sha256.New, c.cacheKey)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	var key [sha256.Size]byte
+	mac.Sum(key[:0])
+
+	c.mu.Lock()
+	_, cached := c.verified[key]
+	c.mu.Unlock()
+	if found && cached {
+		return user, true
+	}
+
+	hashSlots <- struct{}{}
+	ok := h.verify(password)
+	<-hashSlots
+	if !found || !ok {
+		return "", false
+	}
+
+	c.mu.Lock()
+	if len(c.verified) >= verifiedCacheSize {
+		clear(c.verified)
+	}
+	c.verified[key] = struct{}{}
+	c.mu.Unlock()
+	return user, true
+}
+
+// parsePasswordHash parses a bcrypt or argon2id hash.
+func parsePasswordHash(hash string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, err
+		}
+		return bcryptHash(hash), nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return parseArgon2idHash(hash)
+	}
+	return nil, errors.New("unsupported password hash, expected bcrypt or argon2id")
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+func (h bcryptHash) dummy() (passwordHash, error) {
+	cost, err := bcrypt.Cost(h)
+	if err != nil {
+		return nil, err
+	}
+	return newBcryptDummy(cost)
+}
+
+// newBcryptDummy hashes a random password with cost.
+func newBcryptDummy(cost int) (passwordHash, error) {
+	password := make([]byte, 16)
+	rand.Read(password)
+	h, err := bcrypt.GenerateFromPassword(password, cost)
+	return bcryptHash(h), err
+}
+
+// argon2idHash is an argon2id hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash with unpadded base64 salt and hash.
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	errFormat := errors.New("invalid argon2id hash, expected $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>")
+
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[2] != "v="+strconv.Itoa(argon2.Version) {
+		return nil, errFormat
+	}
+
+	h := &argon2idHash{}
+	for _, param := range strings.Split(fields[3], ",") {
+		key, value, _ := strings.Cut(param, "=")
+		var err error
+		var n uint64
+		switch key {
+		case "m":
+			n, err = strconv.ParseUint(value, 10, 32)
+			h.memory = uint32(n)
+		case "t":
+			n, err = strconv.ParseUint(value, 10, 32)
+			h.time = uint32(n)
+		case "p":
+			n, err = strconv.ParseUint(value, 10, 8)
+			h.threads = uint8(n)
+		default:
+			err = errFormat
+		}
+		if err != nil {
+			return nil, errFormat
+		}
+	}
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return nil, errFormat
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(fields[4]); err != nil {
+		return nil, errFormat
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(fields[5]); err != nil || len(h.key) == 0 {
+		return nil, errFormat
+	}
+	return h, nil
+}
+
+func (h *argon2idHash) verify(password string) bool {
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+func (h *argon2idHash) dummy() (passwordHash, error) {
+	d := *h
+	d.salt = make([]byte, len(h.salt))
+	d.key = make([]byte, len(h.key))
+	rand.Read(d.salt)
+	rand.Read(d.key)
+	return &d, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// dialReply returns the SOCKS5 reply for an error from resolving or
+// connecting to a destination.
+func dialReply(err error) uint8 {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return statute.RepTTLExpired
+		}
+		return statute.RepHostUnreachable
+	}
+
+	switch {
+	case errorIs(err, refusedErrnos):
+		return statute.RepConnectionRefused
+	case errorIs(err, networkUnreachableErrnos):
+		return statute.RepNetworkUnreachable
+	case errorIs(err, hostUnreachableErrnos):
+		return statute.RepHostUnreachable
+	case errorIs(err, timeoutErrnos), isTimeout(err):
+		return statute.RepTTLExpired
+	case errorIs(err, deniedErrnos):
+		// blocked by a local firewall
+		return statute.RepRuleFailure
+	case errorIs(err, addrFamilyErrnos):
+		// the agent has no IPv6, or no IPv4
+		return statute.RepAddrTypeNotSupported
+	}
+	return statute.RepServerFailure
+}
+
+// errorIs reports whether err is any of errnos.
+func errorIs(err error, errnos []syscall.Errno) bool {
+	for _, errno := range errnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+var (
+	refusedErrnos            = []syscall.Errno{syscall.ECONNREFUSED}
+	networkUnreachableErrnos = []syscall.Errno{syscall.ENETUNREACH}
+	hostUnreachableErrnos    = []syscall.Errno{syscall.EHOSTUNREACH, syscall.EHOSTDOWN}
+	timeoutErrnos            = []syscall.Errno{syscall.ETIMEDOUT}
+	deniedErrnos             = []syscall.Errno{syscall.EACCES, syscall.EPERM}
+	addrFamilyErrnos         = []syscall.Errno{syscall.EAFNOSUPPORT}
+)
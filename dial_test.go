@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// closedPort returns an address on the loopback interface nothing listens on.
+func closedPort(t *testing.T) (net.IP, int) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	return addr.IP, addr.Port
+}
+
+// fakeDNS serves DNS on the loopback interface, answering every query with
+// NXDOMAIN, or never answering if silent.
+func fakeDNS(t *testing.T, silent bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if silent {
+				continue
+			}
+			if resp := nxdomain(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// nxdomain returns the NXDOMAIN response to a query with a single question.
+func nxdomain(query []byte) []byte {
+	const headerSize = 12
+	// skip the name, then the type and class
+	end := headerSize
+	for end < len(query) && query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	end += 1 + 4
+	if end > len(query) {
+		return nil
+	}
+	resp := append([]byte(nil), query[:end]...)
+	resp[2], resp[3] = 0x81, 0x83 // a recursive answer, NXDOMAIN
+	// one question, and no answer, authority or additional records
+	clear(resp[6:headerSize])
+	return resp
+}
+
+func TestDialReply(t *testing.T) {
+	tests := []struct {
+		name string
+		err  func(t *testing.T) error
+		want uint8
+	}{
+		{
+			name: "refused",
+			err: func(t *testing.T) error {
+				d, _ := newDestDialer(DialConfig{})
+				ip, port := closedPort(t)
+				_, err := d.dial(context.Background(), "tcp", []net.IP{ip}, port)
+				return err
+			},
+			want: statute.RepConnectionRefused,
+		},
+		{
+			name: "connect timeout",
+			err: func(t *testing.T) error {
+				d, _ := newDestDialer(DialConfig{Timeout: time.Nanosecond})
+				ctx, cancel := d.withTimeout(context.Background())
+				defer cancel()
+				ip, port := closedPort(t)
+				_, err := d.dial(ctx, "tcp", []net.IP{ip}, port)
+				return err
+			},
+			want: statute.RepTTLExpired,
+		},
+		{
+			name: "NXDOMAIN",
+			err: func(t *testing.T) error {
+				d, _ := newDestDialer(DialConfig{Servers: dnsServers{fakeDNS(t, false)}, Timeout: 5 * time.Second})
+				_, err := d.lookup(context.Background(), "nonexistent.test.")
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("lookup failed with %v, want NXDOMAIN", err)
+				}
+				return err
+			},
+			want: statute.RepHostUnreachable,
+		},
+		{
+			name: "DNS timeout",
+			err: func(t *testing.T) error {
+				d, _ := newDestDialer(DialConfig{Servers: dnsServers{fakeDNS(t, true)}, Timeout: 100 * time.Millisecond})
+				ctx, cancel := d.withTimeout(context.Background())
+				defer cancel()
+				_, err := d.lookup(ctx, "slow.test.")
+				return err
+			},
+			want: statute.RepTTLExpired,
+		},
+		{
+			name: "deadline exceeded",
+			err:  func(*testing.T) error { return fmt.Errorf("dialing: %w", context.DeadlineExceeded) },
+			want: statute.RepTTLExpired,
+		},
+		// the routes that make these happen cannot be set up in a test, so the
+		// errors are made the way net.Dialer returns them
+		{
+			name: "network unreachable",
+			err:  func(*testing.T) error { return connectError(syscall.ENETUNREACH) },
+			want: statute.RepNetworkUnreachable,
+		},
+		{
+			name: "host unreachable",
+			err:  func(*testing.T) error { return connectError(syscall.EHOSTUNREACH) },
+			want: statute.RepHostUnreachable,
+		},
+		{
+			name: "connect timed out",
+			err:  func(*testing.T) error { return connectError(syscall.ETIMEDOUT) },
+			want: statute.RepTTLExpired,
+		},
+		{
+			name: "denied by a firewall",
+			err:  func(*testing.T) error { return connectError(syscall.EACCES) },
+			want: statute.RepRuleFailure,
+		},
+		{
+			name: "address family not supported",
+			err:  func(*testing.T) error { return connectError(syscall.EAFNOSUPPORT) },
+			want: statute.RepAddrTypeNotSupported,
+		},
+		{
+			name: "other",
+			err:  func(*testing.T) error { return errors.New("no addresses to connect to") },
+			want: statute.RepServerFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err(t)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if got := dialReply(err); got != tt.want {
+				t.Errorf("dialReply(%v) = %d, want %d", err, got, tt.want)
+			}
+		})
+	}
+}
+
+// connectError returns errno as net.Dialer returns it from a failed connect.
+func connectError(errno syscall.Errno) error {
+	return &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Addr: &net.TCPAddr{
+			IP:   net.IPv4(192, 0, 2, 1),
+			Port: 80,
+		},
+		Err: os.NewSyscallError("connect", errno),
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "syscall"
+
+// Winsock reports connection failures with its own error codes, and the
+// overlapped ConnectEx with the equivalent system error codes.
+var (
+	refusedErrnos            = []syscall.Errno{syscall.ECONNREFUSED, 10061, 1225}   // WSAECONNREFUSED, ERROR_CONNECTION_REFUSED
+	networkUnreachableErrnos = []syscall.Errno{syscall.ENETUNREACH, 10051, 1231}    // WSAENETUNREACH, ERROR_NETWORK_UNREACHABLE
+	hostUnreachableErrnos    = []syscall.Errno{syscall.EHOSTUNREACH, 10065, 1232}   // WSAEHOSTUNREACH, ERROR_HOST_UNREACHABLE
+	timeoutErrnos            = []syscall.Errno{syscall.ETIMEDOUT, 10060, 1460, 121} // WSAETIMEDOUT, ERROR_TIMEOUT, ERROR_SEM_TIMEOUT
+	deniedErrnos             = []syscall.Errno{syscall.EACCES, 10013}               // WSAEACCES
+	addrFamilyErrnos         = []syscall.Errno{syscall.EAFNOSUPPORT, 10047}         // WSAEAFNOSUPPORT
+)
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// A localForward tunnels every connection to a listener on the server to a
+// fixed destination in an agent's network, for clients that cannot speak SOCKS.
+type localForward struct {
+	Agent  string // through this agent, or the default agent if empty
+	Listen string
+	Dest   statute.AddrSpec
+}
+
+// parseLocalForward parses a rule of the form [agent@]listen=dest, for example
+// "127.0.0.1:3389=10.0.0.5:3389".
+func parseLocalForward(rule string) (localForward, error) {
+	var lf localForward
+
+	listen, dest, ok := strings.Cut(rule, "=")
+	if !ok {
+		return lf, fmt.Errorf("forward %q is not of the form [agent@]listen=dest", rule)
+	}
+	if i := strings.LastIndexByte(listen, '@'); i >= 0 {
+		lf.Agent, listen = listen[:i], listen[i+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return lf, fmt.Errorf("forward %q has a bad listen address, %v", rule, err)
+	}
+	lf.Listen = listen
+	var err error
+	if lf.Dest, err = statute.ParseAddrSpec(dest); err != nil {
+		return lf, fmt.Errorf("forward %q has a bad destination address, %v", rule, err)
+	}
+	return lf, nil
+}
+
+func (lf localForward) String() string {
+	rule := lf.Listen + "=" + lf.Dest.String()
+	if lf.Agent != "" {
+		rule = lf.Agent + "@" + rule
+	}
+	return rule
+}
+
+// localForwards is a flag of local forward rules that may be given more than
+// once.
+type localForwards []localForward
+
+func (l *localForwards) String() string { return joinRules(*l) }
+
+func (l *localForwards) Set(rule string) error {
+	lf, err := parseLocalForward(rule)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, lf)
+	return nil
+}
+
+func (l *localForwards) repeatable() {}
+
+// serveLocalForward accepts connections for the local forward listening on
+// listen until ln is closed.
+func serveLocalForward(ln net.Listener, listen string, s *reverseServer) {
+	if lf, ok := s.localForward(listen); ok {
+		slog.Info("Listening for port forward clients", "listen", ln.Addr().String(), "dest", lf.Dest.String())
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Failed to accept a port forward client", "err", err)
+			continue
+		}
+		go handleLocalForward(conn, listen, s)
+	}
+}
+
+func handleLocalForward(conn net.Conn, listen string, s *reverseServer) {
+	defer conn.Close()
+
+	// the rule may have changed since the listener was opened
+	lf, ok := s.localForward(listen)
+	if !ok {
+		return
+	}
+	rules := s.settings().rules
+	logger := slog.With("client", conn.RemoteAddr().String(), "dest", lf.Dest.String())
+
+	// forwards have no user, only rules for any user apply
+	if !allowedAnyAgent(logger, rules, "", lf.Dest) {
+		return
+	}
+	stream, _, err := s.agents.connect(lf.Agent, lf.Dest, func(a *Agent, stream net.Conn) bool {
+		return allowedOnStream(logger, rules, "", a, stream, lf.Dest)
+	})
+	if err != nil {
+		logger.Warn("Port forward failed", "err", err)
+		return
+	}
+	defer stream.Close()
+	setStreamInfo(stream, &streamInfo{Kind: "forward", Source: conn.RemoteAddr().String(), Dest: lf.Dest.String(), client: conn})
+
+	splice(stream, stream, conn)
+}
+
+// Reverse port forwards use two commands private to the tunnel, in the range
+// RFC 1928 leaves unassigned. The server sends commandReverseListen to have an
+// agent listen on DST.ADDR, and the agent opens a new stream with
+// commandReverseConnect, echoing that DST.ADDR, for every connection it
+// accepts there.
+const (
+	commandReverseListen  = byte(0x80)
+	commandReverseConnect = byte(0x81)
+)
+
+// A reverseForward exposes a service the server can reach inside an agent's
+// network. The agent listens on Listen and the server dials Dial for every
+// connection accepted there.
+type reverseForward struct {
+	Agent  string // only on this agent, or on every agent if empty
+	Listen statute.AddrSpec
+	Dial   string
+}
+
+// parseReverseForward parses a rule of the form [agent@]listen=dial, for
+// example "dmz@0.0.0.0:8080=127.0.0.1:80".
+func parseReverseForward(rule string) (reverseForward, error) {
+	var rf reverseForward
+
+	listen, dial, ok := strings.Cut(rule, "=")
+	if !ok {
+		return rf, fmt.Errorf("reverse forward %q is not of the form [agent@]listen=dial", rule)
+	}
+	if i := strings.LastIndexByte(listen, '@'); i >= 0 {
+		rf.Agent, listen = listen[:i], listen[i+1:]
+	}
+
+	var err error
+	if rf.Listen, err = statute.ParseAddrSpec(listen); err != nil {
+		return rf, fmt.Errorf("reverse forward %q has a bad listen address, %v", rule, err)
+	}
+	if _, _, err = net.SplitHostPort(dial); err != nil {
+		return rf, fmt.Errorf("reverse forward %q has a bad dial address, %v", rule, err)
+	}
+	rf.Dial = dial
+	return rf, nil
+}
+
+func (rf reverseForward) String() string {
+	rule := rf.Listen.String() + "=" + rf.Dial
+	if rf.Agent != "" {
+		rule = rf.Agent + "@" + rule
+	}
+	return rule
+}
+
+// reverseForwards is a flag of reverse forward rules that may be given more
+// than once.
+type reverseForwards []reverseForward
+
+func (r *reverseForwards) String() string { return joinRules(*r) }
+
+func (r *reverseForwards) Set(rule string) error {
+	rf, err := parseReverseForward(rule)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rf)
+	return nil
+}
+
+func (r *reverseForwards) repeatable() {}
+
+// joinRules formats the rules of a list flag.
+func joinRules[T fmt.Stringer](rules []T) string {
+	s := make([]string, len(rules))
+	for i, rule := range rules {
+		s[i] = rule.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// appliesTo reports whether the rule should be set up on agent.
+func (rf reverseForward) appliesTo(agent *Agent) bool {
+	return rf.Agent == "" || rf.Agent == agent.Name || rf.Agent == fmt.Sprint(agent.ID)
+}
+
+// syncReverseForwards starts the rules that apply to agent and are not
+// running on it yet, and stops those that are no longer in rules. A rule is
+// identified by its listen address, the address it dials is looked up for
+// every connection.
+func syncReverseForwards(agent *Agent, rules []reverseForward) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	wanted := make(map[string]reverseForward)
+	for _, rf := range rules {
+		key := rf.Listen.String()
+		if _, ok := wanted[key]; !ok && rf.appliesTo(agent) {
+			wanted[key] = rf
+		}
+	}
+
+	for key, stream := range agent.reverseForwards {
+		if _, ok := wanted[key]; !ok {
+			agent.log.Info("Stopping reverse forward", "listen", key)
+			stream.Close()
+			delete(agent.reverseForwards, key)
+		}
+	}
+	for key, rf := range wanted {
+		if _, ok := agent.reverseForwards[key]; ok {
+			continue
+		}
+		stream, err := agent.session.OpenStream()
+		if err != nil {
+			return
+		}
+		agent.reverseForwards[key] = stream
+		setStreamInfo(stream, &streamInfo{Kind: "rforward-listen", Source: key, Dest: rf.Dial})
+		go startReverseForward(agent, rf, stream)
+	}
+}
+
+// startReverseForward asks agent to listen for the rule. The listener stays up
+// for as long as stream, which carries the request, is open.
+func startReverseForward(agent *Agent, rf reverseForward, stream net.Conn) {
+	defer func() {
+		stream.Close()
+		// forget the rule, so a later reload can try again
+		agent.mu.Lock()
+		if agent.reverseForwards[rf.Listen.String()] == stream {
+			delete(agent.reverseForwards, rf.Listen.String())
+		}
+		agent.mu.Unlock()
+	}()
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: commandReverseListen,
+		DstAddr: rf.Listen,
+	}
+	if _, err := stream.Write(req.Bytes()); err != nil {
+		return
+	}
+	rep, err := statute.ParseReply(stream)
+	if err != nil {
+		return
+	}
+	if rep.Response != statute.RepSuccess {
+		agent.log.Warn("Agent could not listen for reverse forward", "listen", rf.Listen.String(), "reply", rep.Response)
+		return
+	}
+	agent.log.Info("Agent listening for reverse forward", "listen", rep.BndAddr.String(), "dial", rf.Dial)
+
+	// nothing else is sent on the stream, it ends with the agent
+	io.Copy(io.Discard, stream) //nolint: errcheck
+}
+
+// serveReverseStreams accepts the streams agent opens for connections to its
+// reverse forward listeners, and dials the matching rule's target.
+func serveReverseStreams(agent *Agent, s *reverseServer) {
+	for {
+		stream, err := agent.session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			rules := s.settings().config.ReverseForwards
+			if err := handleReverseStream(stream, agent, rules); err != nil {
+				withStream(agent.log, agent, stream).Warn("Reverse forward failed", "err", err)
+			}
+		}()
+	}
+}
+
+func handleReverseStream(stream net.Conn, agent *Agent, rules []reverseForward) error {
+	defer stream.Close()
+
+	request, err := statute.ParseRequest(stream)
+	if err != nil {
+		return fmt.Errorf("failed to read reverse forward request, %v", err)
+	}
+	if request.Command != commandReverseConnect {
+		SendReply(stream, statute.RepCommandNotSupported, nil) //nolint: errcheck
+		return fmt.Errorf("agent %d sent unexpected command[%d]", agent.ID, request.Command)
+	}
+
+	// only dial out for listeners this agent was asked to open
+	var rule *reverseForward
+	for i := range rules {
+		if rules[i].appliesTo(agent) && rules[i].Listen.String() == request.DstAddr.String() {
+			rule = &rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		SendReply(stream, statute.RepRuleFailure, nil) //nolint: errcheck
+		return fmt.Errorf("agent %d sent connection for unknown reverse forward %v", agent.ID, request.DstAddr.String())
+	}
+
+	target, err := net.Dial("tcp", rule.Dial)
+	if err != nil {
+		SendReply(stream, dialReply(err), nil) //nolint: errcheck
+		return fmt.Errorf("reverse forward to %s failed, %v", rule.Dial, err)
+	}
+	defer target.Close()
+	setStreamInfo(stream, &streamInfo{Kind: "rforward", Source: request.DstAddr.String(), Dest: rule.Dial, client: target, reply: new(statute.RepSuccess)})
+
+	if err := SendReply(stream, statute.RepSuccess, target.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+	splice(stream, stream, target)
+	return nil
+}
+
+// handleReverseListen is used to handle a reverse listen command on the agent.
+// Every connection accepted is handed to the server on a new stream, until the
+// server closes this one.
+func (sf *SocksServer) handleReverseListen(writer io.Writer, request *Request) error {
+
+	ln, err := net.Listen("tcp", request.DestAddr.String())
+	if err != nil {
+		if err := sf.sendReply(writer, request, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen for reverse forward on %v failed, %v", request.RawDestAddr, err)
+	}
+	defer ln.Close()
+
+	if err := sf.sendReply(writer, request, statute.RepSuccess, ln.Addr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sf.reverseConnect(conn, *request.RawDestAddr)
+		}
+	}()
+
+	// the listener is closed once the server closes the stream
+	io.Copy(io.Discard, request.Reader) //nolint: errcheck
+	return nil
+}
+
+// reverseConnect hands a connection accepted by a reverse forward listener to
+// the server.
+func (sf *SocksServer) reverseConnect(conn net.Conn, listenAddr statute.AddrSpec) {
+	defer conn.Close()
+
+	stream, err := sf.session.OpenStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: commandReverseConnect,
+		DstAddr: listenAddr,
+	}
+	if _, err := stream.Write(req.Bytes()); err != nil {
+		return
+	}
+	rep, err := statute.ParseReply(stream)
+	if err != nil {
+		return
+	}
+	if rep.Response != statute.RepSuccess {
+		sf.logger.Warn("Server refused reverse forward", "client", conn.RemoteAddr().String(), "reply", rep.Response)
+		return
+	}
+	splice(stream, stream, conn)
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"strings"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/Acebond/ReverseSocks5/acl"
 	"github.com/Acebond/ReverseSocks5/statute"
 )
 
+// bindTimeout is how long a bind command waits for the inbound connection.
+const bindTimeout = time.Minute * 2
+
 // A Request represents request received by a server
 type Request struct {
 	statute.Request
@@ -27,6 +34,13 @@ type Request struct {
 	Reader io.Reader
 	// RawDestAddr of the desired destination
 	RawDestAddr *statute.AddrSpec
+	// DestIPs are the addresses DestAddr resolved to, in the order to try them
+	DestIPs []net.IP
+	// ServerRules are the rules of the server's access control list to check
+	// once hostnames are resolved, if any
+	ServerRules *acl.List
+	// Logger has the stream and destination of the request
+	Logger *slog.Logger
 }
 
 // ParseRequest creates a new Request from the tcp connection
@@ -43,35 +57,61 @@ func ParseRequest(bufConn io.Reader) (*Request, error) {
 }
 
 // handleRequest is used for request processing after authentication
-func handleRequest(write io.Writer, req *Request) error {
+func (sf *SocksServer) handleRequest(write io.Writer, req *Request) error {
+
+	// resolving and connecting share the dial timeout
+	ctx, cancel := sf.dialer.withTimeout(context.Background())
+	defer cancel()
 
 	// Resolve the address if we have a FQDN
 	dest := req.RawDestAddr
+	req.DestIPs = []net.IP{dest.IP}
 	if dest.FQDN != "" {
-		addr, err := net.ResolveIPAddr("ip", dest.FQDN)
+		ips, err := sf.dialer.lookup(ctx, dest.FQDN)
 		if err != nil {
-			if err := SendReply(write, statute.RepHostUnreachable, nil); err != nil {
+			if err := sf.sendReply(write, req, dialReply(err), nil); err != nil {
 				return fmt.Errorf("failed to send reply, %v", err)
 			}
 			return fmt.Errorf("failed to resolve destination[%v], %v", dest.FQDN, err)
 		}
-		dest.IP = addr.IP
+		req.DestIPs, dest.IP = ips, ips[0]
 	}
 
 	// Apply any address rewrites
 	req.DestAddr = req.RawDestAddr
 
+	// Enforce the agent's own policy, now that the addresses are known. Only
+	// the addresses it allows are tried. Reverse listens do not reach out, so
+	// only the outbound commands are checked.
+	switch req.Command {
+	case statute.CommandConnect, statute.CommandBind:
+		ips, rule := sf.allowedIPs(*req.RawDestAddr, req.DestIPs, req.ServerRules)
+		if len(ips) == 0 {
+			if err := sf.sendReply(write, req, statute.RepRuleFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply, %v", err)
+			}
+			return fmt.Errorf("request to %v denied by rule %q", req.RawDestAddr.Address(), rule.Text)
+		}
+		req.DestIPs, dest.IP = ips, ips[0]
+	}
+
 	// Switch on the command
 	switch req.Command {
 
 	case statute.CommandConnect:
-		return handleConnect(write, req)
+		return sf.handleConnect(ctx, write, req)
+
+	case statute.CommandBind:
+		return sf.handleBind(write, req)
 
 	case statute.CommandAssociate:
-		return handleAssociate(write, req)
+		return sf.handleAssociate(write, req)
+
+	case commandReverseListen:
+		return sf.handleReverseListen(write, req)
 
 	default:
-		if err := SendReply(write, statute.RepCommandNotSupported, nil); err != nil {
+		if err := sf.sendReply(write, req, statute.RepCommandNotSupported, nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
 		return fmt.Errorf("unsupported command[%v]", req.Command)
@@ -79,173 +119,257 @@ func handleRequest(write io.Writer, req *Request) error {
 }
 
 // handleConnect is used to handle a connect command
-func handleConnect(writer io.Writer, request *Request) error {
+func (sf *SocksServer) handleConnect(ctx context.Context, writer io.Writer, request *Request) error {
 
-	target, err := net.Dial("tcp", request.DestAddr.String())
+	target, err := sf.dialer.dial(ctx, "tcp", request.DestIPs, request.DestAddr.Port)
 	if err != nil {
-		msg := err.Error()
-		resp := statute.RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = statute.RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = statute.RepNetworkUnreachable
-		}
-		if err := SendReply(writer, resp, nil); err != nil {
+		if err := sf.sendReply(writer, request, dialReply(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
 		return fmt.Errorf("connect to %v failed, %v", request.RawDestAddr, err)
 	}
 	defer target.Close()
+	// report the address that answered
+	request.DestAddr.IP = target.RemoteAddr().(*net.TCPAddr).IP
 
 	// Send success
-	if err := SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+	if err := sf.sendReply(writer, request, statute.RepSuccess, target.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	splice(writer, request.Reader, target)
+	return nil
+}
+
+// handleBind is used to handle a bind command. A listener is opened in the
+// agent's network and announced in the first reply, then the connection from
+// the expected peer is announced in the second reply and spliced onto the
+// stream.
+func (sf *SocksServer) handleBind(writer io.Writer, request *Request) error {
+
+	bindLn, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		if err := sf.sendReply(writer, request, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen tcp failed, %v", err)
+	}
+	defer bindLn.Close()
+
+	// announce an address the peer can reach instead of the wildcard address
+	bindAddr := &net.TCPAddr{
+		IP:   outboundIP(request),
+		Port: bindLn.Addr().(*net.TCPAddr).Port,
+	}
+	if err := sf.sendReply(writer, request, statute.RepSuccess, bindAddr); err != nil {
 		return fmt.Errorf("failed to send reply, %v", err)
 	}
 
-	// Start proxying
+	// DST.ADDR is the peer the client expects to connect
+	expected := request.DestAddr.IP
+	bindLn.SetDeadline(time.Now().Add(bindTimeout))
+	var target *net.TCPConn
+	for {
+		target, err = bindLn.AcceptTCP()
+		if err != nil {
+			resp := statute.RepServerFailure
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				resp = statute.RepTTLExpired
+			}
+			if err := sf.sendReply(writer, request, resp, nil); err != nil {
+				return fmt.Errorf("failed to send reply, %v", err)
+			}
+			return fmt.Errorf("bind for %v failed, %v", request.RawDestAddr, err)
+		}
+		peer := target.RemoteAddr().(*net.TCPAddr)
+		if len(expected) == 0 || expected.IsUnspecified() || expected.Equal(peer.IP) {
+			break
+		}
+		request.Logger.Info("Bind rejected a connection from an unexpected peer", "peer", peer.String())
+		target.Close()
+	}
+	defer target.Close()
+	bindLn.Close()
+
+	// Send the peer's address
+	if err := sf.sendReply(writer, request, statute.RepSuccess, target.RemoteAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	splice(writer, request.Reader, target)
+	return nil
+}
+
+// outboundIP returns the agent's IP on the route towards the bind request's
+// destination, falling back to the IP the agent reaches the server from.
+func outboundIP(request *Request) net.IP {
+	if ip := request.DestAddr.IP; len(ip) != 0 && !ip.IsUnspecified() {
+		// connecting a UDP socket picks a route without sending anything
+		if conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "9")); err == nil {
+			defer conn.Close()
+			return conn.LocalAddr().(*net.UDPAddr).IP
+		}
+	}
+	if tcpAddr, ok := request.LocalAddr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return net.IPv4zero
+}
+
+// splice proxies data between the stream and target until either side is
+// done.
+func splice(writer io.Writer, reader io.Reader, target net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		buf := bufferPool.Get()
 		defer bufferPool.Put(buf)
-		io.CopyBuffer(target, request.Reader, buf[:cap(buf)])
+		io.CopyBuffer(target, reader, buf[:cap(buf)])
+		// The stream is gone, nothing more can be sent back either.
+		target.Close()
 		wg.Done()
 	}()
 	go func() {
 		buf := bufferPool.Get()
 		defer bufferPool.Put(buf)
 		io.CopyBuffer(writer, target, buf[:cap(buf)])
+		// The target is done, streams cannot be half closed so close it all.
+		if c, ok := writer.(io.Closer); ok {
+			c.Close()
+		}
 		wg.Done()
 	}()
 
 	wg.Wait()
-
-	return nil
 }
 
-// handleAssociate is used to handle a connect command
-func handleAssociate(writer io.Writer, request *Request) error {
+// handleAssociate is used to handle an associate command. The UDP socket the
+// client talks to is owned by the server, the datagrams arrive here over the
+// stream and are relayed to their destinations.
+func (sf *SocksServer) handleAssociate(writer io.Writer, request *Request) error {
 
-	bindLn, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
-			return fmt.Errorf("failed to send reply, %v", err)
-		}
-		return fmt.Errorf("listen udp failed, %v", err)
-	}
-	log.Printf("client want to used addr %v, listen addr: %s", request.DestAddr, bindLn.LocalAddr())
-	// send BND.ADDR and BND.PORT, client used
-	if err = SendReply(writer, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
+	// BND.ADDR is meaningless to the server, it binds its own socket
+	if err := sf.sendReply(writer, request, statute.RepSuccess, &net.UDPAddr{IP: net.IPv4zero}); err != nil {
 		return fmt.Errorf("failed to send reply, %v", err)
 	}
 
-	go func() {
-		// read from client and write to remote server
-		conns := sync.Map{}
-		bufPool := bufferPool.Get()
-		defer func() {
-			bufferPool.Put(bufPool)
-			bindLn.Close()
-			conns.Range(func(key, value any) bool {
-				if connTarget, ok := value.(net.Conn); !ok {
-					log.Printf("conns has illegal item %v:%v", key, value)
-				} else {
-					connTarget.Close()
-				}
-				return true
-			})
-		}()
-		for {
-			n, srcAddr, err := bindLn.ReadFromUDP(bufPool[:cap(bufPool)])
-			if err != nil {
-				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-					return
-				}
-				continue
-			}
-			pk, err := statute.ParseDatagram(bufPool[:n])
-			if err != nil {
-				continue
+	// replies from every target are written to the same stream
+	var writeMutex sync.Mutex
+
+	conns := sync.Map{}
+	defer func() {
+		conns.Range(func(key, value any) bool {
+			if connTarget, ok := value.(net.Conn); !ok {
+				request.Logger.Error("Illegal item in the udp connections", "key", key, "value", value)
+			} else {
+				connTarget.Close()
 			}
+			return true
+		})
+	}()
 
-			// check src addr whether equal requst.DestAddr
-			srcEqual := ((request.DestAddr.IP.IsUnspecified()) || request.DestAddr.IP.Equal(srcAddr.IP)) && (request.DestAddr.Port == 0 || request.DestAddr.Port == srcAddr.Port) //nolint:lll
-			if !srcEqual {
-				continue
+	bufPool := bufferPool.Get()
+	defer bufferPool.Put(bufPool)
+
+	for {
+		datagram, err := readDatagram(request.Reader, bufPool[:cap(bufPool)])
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
 			}
+			return err
+		}
+		pk, err := statute.ParseDatagram(datagram)
+		if err != nil || pk.Frag != 0 {
+			continue
+		}
 
-			connKey := srcAddr.String() + "--" + pk.DstAddr.String()
+		connKey := pk.DstAddr.String()
 
-			if target, ok := conns.Load(connKey); !ok {
-				// if the 'connection' doesn't exist, create one and store it
-				targetNew, err := net.Dial("udp", pk.DstAddr.String())
+		if target, ok := conns.Load(connKey); !ok {
+			// if the 'connection' doesn't exist, create one and store it
+			ip := pk.DstAddr.IP
+			if pk.DstAddr.FQDN != "" {
+				ctx, cancel := sf.dialer.withTimeout(context.Background())
+				ips, err := sf.dialer.lookup(ctx, pk.DstAddr.FQDN)
+				cancel()
 				if err != nil {
-					log.Printf("connect to %v failed, %v", pk.DstAddr, err)
-					// TODO:continue or return Error?
+					request.Logger.Warn("UDP resolve failed", "udp_dest", pk.DstAddr.String(), "err", err)
 					continue
 				}
-				conns.Store(connKey, targetNew)
-				// read from remote server and write to original client
-				go func() {
-					bufPool := bufferPool.Get()
-					defer func() {
-						targetNew.Close()
-						conns.Delete(connKey)
-						bufferPool.Put(bufPool)
-					}()
-
-					for {
-						buf := bufPool[:cap(bufPool)]
-						n, err := targetNew.Read(buf)
-						if err != nil {
-							if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-								return
-							}
-							log.Printf("read data from remote %s failed, %v", targetNew.RemoteAddr().String(), err)
-							return
-						}
-						tmpBufPool := bufferPool.Get()
-						proBuf := tmpBufPool
-						proBuf = append(proBuf, pk.Header()...)
-						proBuf = append(proBuf, buf[:n]...)
-						if _, err := bindLn.WriteTo(proBuf, srcAddr); err != nil {
-							bufferPool.Put(tmpBufPool)
-							log.Printf("write data to client %s failed, %v", srcAddr, err)
+				ip = ips[0]
+			}
+			targetNew, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(pk.DstAddr.Port)))
+			if err != nil {
+				request.Logger.Warn("UDP connect failed", "udp_dest", pk.DstAddr.String(), "err", err)
+				continue
+			}
+			// check the policy against the address the hostname resolved to
+			dest := pk.DstAddr
+			dest.IP = targetNew.RemoteAddr().(*net.UDPAddr).IP
+			if rule := sf.denied(dest, request.ServerRules); rule != nil {
+				request.Logger.Info("Datagram denied", "udp_dest", dest.Address(), "rule", rule.Text)
+				targetNew.Close()
+				continue
+			}
+			conns.Store(connKey, targetNew)
+			header := pk.Header()
+			// read from remote server and write to original client
+			go func() {
+				bufPool := bufferPool.Get()
+				defer func() {
+					targetNew.Close()
+					conns.Delete(connKey)
+					bufferPool.Put(bufPool)
+				}()
+
+				proBuf := append(bufPool[:0], header...)
+				for {
+					n, err := targetNew.Read(proBuf[len(header):cap(proBuf)])
+					if err != nil {
+						if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 							return
 						}
-						bufferPool.Put(tmpBufPool)
+						request.Logger.Warn("Failed to read a datagram", "udp_dest", targetNew.RemoteAddr().String(), "err", err)
+						return
+					}
+					writeMutex.Lock()
+					err = writeDatagram(writer, proBuf[:len(header)+n])
+					writeMutex.Unlock()
+					if err != nil {
+						request.Logger.Warn("Failed to send a datagram to the server", "err", err)
+						return
 					}
-				}()
-				if _, err := targetNew.Write(pk.Data); err != nil {
-					log.Printf("write data to remote server %s failed, %v", targetNew.RemoteAddr().String(), err)
-					return
-				}
-			} else {
-				if _, err := target.(net.Conn).Write(pk.Data); err != nil {
-					log.Printf("write data to remote server %s failed, %v", target.(net.Conn).RemoteAddr().String(), err)
-					return
 				}
+			}()
+			if _, err := targetNew.Write(pk.Data); err != nil {
+				request.Logger.Warn("Failed to write a datagram", "udp_dest", targetNew.RemoteAddr().String(), "err", err)
 			}
-		}
-	}()
-
-	buf := bufferPool.Get()
-	defer bufferPool.Put(buf)
-
-	for {
-		_, err := request.Reader.Read(buf[:cap(buf)])
-		// sf.logger.Errorf("read data from client %s, %d bytesm, err is %+v", request.RemoteAddr.String(), num, err)
-		if err != nil {
-			bindLn.Close()
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				return nil
+		} else {
+			if _, err := target.(net.Conn).Write(pk.Data); err != nil {
+				request.Logger.Warn("Failed to write a datagram", "udp_dest", target.(net.Conn).RemoteAddr().String(), "err", err)
 			}
-			return err
 		}
 	}
 }
 
+// sendReply sends the reply to req, and reports it to the server along with
+// the address the destination resolved to, for the server's audit log.
+func (sf *SocksServer) sendReply(w io.Writer, req *Request, rep uint8, bindAddr net.Addr) error {
+	if err := SendReply(w, rep, bindAddr); err != nil {
+		return err
+	}
+	report := streamReport{Reply: rep}
+	if ip := req.RawDestAddr.IP; len(ip) != 0 && !ip.IsUnspecified() {
+		report.Resolved = ip.String()
+	}
+	if err := sendStreamReport(w, report); err != nil {
+		req.Logger.Debug("Failed to report the reply", "err", err)
+	}
+	return nil
+}
+
 // SendReply is used to send a reply message
 // rep: reply status see statute's statute file
 func SendReply(w io.Writer, rep uint8, bindAddr net.Addr) error {
@@ -277,6 +401,7 @@ func SendReply(w io.Writer, rep uint8, bindAddr net.Addr) error {
 		}
 	}
 	// Send the message
+	metrics.socksReplies.add(strconv.Itoa(int(rsp.Response)), 1)
 	_, err := w.Write(rsp.Bytes())
 	return err
 }
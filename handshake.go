@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// Before the mux starts, a new connection has to prove it is an agent that
+// knows the pre-shared key. The agent speaks first, offering the range of
+// protocol versions it speaks, and the server stays silent until the agent's
+// hello checks out, so a scanner gets nothing back. The server then answers
+// with the version it picked, or a refusal if there is none in common, and
+// proves it knows the key too. It challenges the agent so that a recorded
+// hello cannot be replayed to register an agent.
+//
+//	agent -> server: MIN VERSION (1) | MAX VERSION (1) | NONCE (32) | HMAC (32)
+//	server -> agent: STATUS (1) | VERSION (1) | CHALLENGE (32) | HMAC (32)
+//	agent -> server: NLEN (1) | NAME (NLEN) | HMAC (32)
+//	server -> agent: STATUS (1)
+//
+// The hellos must keep this layout in every version, so that a mismatch is
+// still reported. A server that does not accept the hello, because the agent
+// uses another key, reads until the handshake times out and hangs up.
+
+const (
+	protocolVersion  = byte(0x01)
+	nonceSize        = 32
+	handshakeTimeout = time.Second * 5
+)
+
+// handshake status
+const (
+	helloAccepted   = byte(0x00)
+	helloBadVersion = byte(0x01)
+	helloBadAuth    = byte(0x02)
+)
+
+// handshake errors
+var (
+	ErrUnsupportedProtocol = errors.New("no protocol version in common with the peer")
+	ErrAgentAuthFailed     = errors.New("agent does not know the pre-shared key")
+	ErrServerAuthFailed    = errors.New("server does not know the pre-shared key")
+	ErrServerHungUp        = errors.New("server hung up on the agent hello, it may use another pre-shared key")
+)
+
+// handshakeMAC authenticates a handshake message, label tells the messages
+// apart.
+func handshakeMAC(psk, label string, fields ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write([]byte("ReverseSocks5 " + label))
+	for _, f := range fields {
+		mac.Write(f)
+	}
+	return mac.Sum(nil)
+}
+
+// serverHandshake checks a new agent connection and returns the name the
+// agent registered with.
+func serverHandshake(conn net.Conn, psk string) (string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 2+nonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return "", fmt.Errorf("could not read agent hello: %w", err)
+	}
+	versions, nonce, mac := hello[:2], hello[2:2+nonceSize], hello[2+nonceSize:]
+	if !hmac.Equal(mac, handshakeMAC(psk, "agent hello", versions, nonce)) {
+		// give nothing away, not even how much we read
+		io.Copy(io.Discard, conn) //nolint: errcheck
+		return "", ErrAgentAuthFailed
+	}
+
+	reply := make([]byte, 2+nonceSize, 2+nonceSize+sha256.Size)
+	reply[0], reply[1] = helloAccepted, protocolVersion
+	if protocolVersion < versions[0] || protocolVersion > versions[1] {
+		reply[0] = helloBadVersion
+	}
+	challenge := reply[2:]
+	rand.Read(challenge)
+	reply = append(reply, handshakeMAC(psk, "server hello", nonce, reply)...)
+	if _, err := conn.Write(reply); err != nil {
+		return "", err
+	}
+	if reply[0] == helloBadVersion {
+		return "", fmt.Errorf("%w: the agent speaks versions %d to %d", ErrUnsupportedProtocol, versions[0], versions[1])
+	}
+
+	nameLen := []byte{0}
+	if _, err := io.ReadFull(conn, nameLen); err != nil {
+		return "", fmt.Errorf("could not read agent answer: %w", err)
+	}
+	answer := make([]byte, int(nameLen[0])+sha256.Size)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return "", fmt.Errorf("could not read agent answer: %w", err)
+	}
+	name, mac := answer[:nameLen[0]], answer[nameLen[0]:]
+
+	if !hmac.Equal(mac, handshakeMAC(psk, "agent answer", nonce, challenge, []byte{protocolVersion}, name)) {
+		conn.Write([]byte{helloBadAuth}) //nolint: errcheck
+		return "", ErrAgentAuthFailed
+	}
+	if _, err := conn.Write([]byte{helloAccepted}); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// agentHandshake proves to the server that the agent knows the pre-shared key
+// and registers it as name.
+func agentHandshake(conn net.Conn, psk, name string) error {
+	// outlast the server, which hangs up when it times out
+	conn.SetDeadline(time.Now().Add(handshakeTimeout + time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 2+nonceSize, 2+nonceSize+sha256.Size)
+	hello[0], hello[1] = protocolVersion, protocolVersion
+	nonce := hello[2:]
+	rand.Read(nonce)
+	hello = append(hello, handshakeMAC(psk, "agent hello", hello[:2], nonce)...)
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2+nonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrServerHungUp
+		}
+		return fmt.Errorf("could not read server hello: %w", err)
+	}
+	header, challenge, mac := reply[:2+nonceSize], reply[2:2+nonceSize], reply[2+nonceSize:]
+	if !hmac.Equal(mac, handshakeMAC(psk, "server hello", nonce, header)) {
+		return ErrServerAuthFailed
+	}
+	status, version := reply[0], reply[1]
+	switch status {
+	case helloAccepted:
+		if version != protocolVersion {
+			return fmt.Errorf("server picked protocol version %d, which the agent did not offer", version)
+		}
+	case helloBadVersion:
+		return fmt.Errorf("%w: the server speaks version %d, the agent %d", ErrUnsupportedProtocol, version, protocolVersion)
+	default:
+		return fmt.Errorf("server rejected the agent hello, status %d", status)
+	}
+
+	if len(name) > math.MaxUint8 {
+		name = name[:math.MaxUint8]
+	}
+	answer := make([]byte, 0, 1+len(name)+sha256.Size)
+	answer = append(answer, byte(len(name)))
+	answer = append(answer, name...)
+	answer = append(answer, handshakeMAC(psk, "agent answer", nonce, challenge, []byte{version}, []byte(name))...)
+	if _, err := conn.Write(answer); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+		return fmt.Errorf("could not read server status: %w", err)
+	}
+	switch reply[0] {
+	case helloAccepted:
+		return nil
+	case helloBadAuth:
+		return ErrAgentAuthFailed
+	default:
+		return fmt.Errorf("server rejected the agent, status %d", reply[0])
+	}
+}
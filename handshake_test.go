@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshakePair runs agentHandshake against serverHandshake and returns
+// their results.
+func handshakePair(t *testing.T, agentPSK, serverPSK, name string) (agentErr error, serverName string, serverErr error) {
+	t.Helper()
+	agentConn, serverConn := net.Pipe()
+	defer agentConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverName, serverErr = serverHandshake(serverConn, serverPSK)
+		serverConn.Close()
+	}()
+	agentErr = agentHandshake(agentConn, agentPSK, name)
+	agentConn.Close()
+	<-done
+	return agentErr, serverName, serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	t.Parallel()
+	agentErr, name, serverErr := handshakePair(t, "psk", "psk", "office")
+	if agentErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed, agent: %v, server: %v", agentErr, serverErr)
+	}
+	if name != "office" {
+		t.Errorf("agent registered as %q, want office", name)
+	}
+}
+
+func TestHandshakeWrongPSK(t *testing.T) {
+	t.Parallel()
+	agentErr, _, serverErr := handshakePair(t, "wrong", "psk", "office")
+	if !errors.Is(serverErr, ErrAgentAuthFailed) {
+		t.Errorf("server failed with %v, want %v", serverErr, ErrAgentAuthFailed)
+	}
+	if !errors.Is(agentErr, ErrServerHungUp) {
+		t.Errorf("agent failed with %v, want %v", agentErr, ErrServerHungUp)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	t.Parallel()
+	const psk = "psk"
+
+	t.Run("server", func(t *testing.T) {
+		agentConn, serverConn := net.Pipe()
+		defer agentConn.Close()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := serverHandshake(serverConn, psk)
+			serverConn.Close()
+			errc <- err
+		}()
+
+		// an agent that only speaks later versions
+		hello := make([]byte, 2+nonceSize)
+		hello[0], hello[1] = protocolVersion+1, protocolVersion+2
+		hello = append(hello, handshakeMAC(psk, "agent hello", hello[:2], hello[2:])...)
+		if _, err := agentConn.Write(hello); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 2+nonceSize+sha256.Size)
+		if _, err := io.ReadFull(agentConn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[0] != helloBadVersion || reply[1] != protocolVersion {
+			t.Errorf("server replied status %d version %d, want %d and %d", reply[0], reply[1], helloBadVersion, protocolVersion)
+		}
+		if !hmac.Equal(reply[2+nonceSize:], handshakeMAC(psk, "server hello", hello[2:2+nonceSize], reply[:2+nonceSize])) {
+			t.Error("refusal is not authenticated")
+		}
+		if err := <-errc; !errors.Is(err, ErrUnsupportedProtocol) {
+			t.Errorf("server failed with %v, want %v", err, ErrUnsupportedProtocol)
+		}
+	})
+
+	t.Run("agent", func(t *testing.T) {
+		agentConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- agentHandshake(agentConn, psk, "office")
+			agentConn.Close()
+		}()
+
+		// a server that only speaks a later version
+		hello := make([]byte, 2+nonceSize+sha256.Size)
+		if _, err := io.ReadFull(serverConn, hello); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 2+nonceSize)
+		reply[0], reply[1] = helloBadVersion, protocolVersion+1
+		reply = append(reply, handshakeMAC(psk, "server hello", hello[2:2+nonceSize], reply)...)
+		if _, err := serverConn.Write(reply); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; !errors.Is(err, ErrUnsupportedProtocol) {
+			t.Errorf("agent failed with %v, want %v", err, ErrUnsupportedProtocol)
+		}
+	})
+}
+
+func TestHandshakeHungUp(t *testing.T) {
+	t.Parallel()
+	agentConn, serverConn := net.Pipe()
+	go func() {
+		// a server that goes away mid-handshake
+		io.ReadFull(serverConn, make([]byte, 2+nonceSize+sha256.Size))
+		serverConn.Close()
+	}()
+	if err := agentHandshake(agentConn, "psk", "office"); !errors.Is(err, ErrServerHungUp) {
+		t.Errorf("agent failed with %v, want %v", err, ErrServerHungUp)
+	}
+}
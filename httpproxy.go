@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// routeContextKey carries the route of a proxied HTTP request.
+type routeContextKey struct{}
+
+// A route is the user a proxied HTTP request is made for and the agent it is
+// tunnelled through.
+type route struct {
+	user  string
+	agent string
+}
+
+// An httpProxy serves HTTP CONNECT and absolute-URI requests, tunnelling each
+// of them through an agent just like a SOCKS5 CONNECT.
+type httpProxy struct {
+	// the users and access control list are those of the server's
+	// configuration when each request arrives
+	server *reverseServer
+
+	reverseProxy *httputil.ReverseProxy
+
+	mu         sync.Mutex
+	transports map[route]*routeTransport
+}
+
+// A routeTransport pools the connections of a route.
+type routeTransport struct {
+	*http.Transport
+	lastUsed time.Time
+}
+
+// maxTransports bounds the routes that keep a pool of connections, so that
+// clients making up usernames cannot hold open ever more streams.
+const maxTransports = 64
+
+// transportIdleTimeout is how long a pooled connection, and a route with
+// nothing pooled, is kept.
+const transportIdleTimeout = 90 * time.Second
+
+func newHTTPProxy(server *reverseServer) *httpProxy {
+	p := &httpProxy{
+		server:     server,
+		transports: make(map[route]*routeTransport),
+	}
+	p.reverseProxy = &httputil.ReverseProxy{
+		// the request URL is already absolute, and the client's address is
+		// not passed on
+		Rewrite:      func(*httputil.ProxyRequest) {},
+		Transport:    p,
+		ErrorHandler: p.serveError,
+	}
+	return p
+}
+
+// ServeHTTP implements http.Handler.
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt, ok := p.authenticate(r)
+	if !ok {
+		if username, _, hasAuth := proxyBasicAuth(r); hasAuth {
+			metrics.authFailures.add("http", 1)
+			slog.Warn("Failed to authenticate http client", "client", r.RemoteAddr, "user", username)
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="ReverseSocks5"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r, rt)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy, requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+	ctx := context.WithValue(r.Context(), routeContextKey{}, rt)
+	p.reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authenticate checks the request's Proxy-Authorization and returns the user
+// and the agent the username names.
+func (p *httpProxy) authenticate(r *http.Request) (route, bool) {
+	settings := p.server.settings()
+	username, password, hasAuth := proxyBasicAuth(r)
+	if settings.auth == nil {
+		// no credentials needed, but the username may still pick an agent
+		if !hasAuth {
+			return route{}, true
+		}
+		user, agent := splitUsername(username)
+		return route{user, agent}, true
+	}
+	if !hasAuth {
+		return route{}, false
+	}
+	user, agent, ok := settings.auth.Valid(username, password)
+	return route{user, agent}, ok
+}
+
+// proxyBasicAuth returns the credentials from the Proxy-Authorization header.
+func proxyBasicAuth(r *http.Request) (username, password string, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	// reuse the parsing of the Authorization header
+	req := http.Request{Header: http.Header{"Authorization": {auth}}}
+	return req.BasicAuth()
+}
+
+// serveConnect tunnels a CONNECT request's connection to its destination.
+func (p *httpProxy) serveConnect(w http.ResponseWriter, r *http.Request, rt route) {
+	dest, err := statute.ParseAddrSpec(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stream, _, err := p.connect(rt, dest)
+	if err != nil {
+		slog.Warn("HTTP connect failed", "client", r.RemoteAddr, "user", rt.user, "dest", r.Host, "err", err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	defer stream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		slog.Warn("HTTP connect failed", "client", r.RemoteAddr, "err", err)
+		return
+	}
+	defer conn.Close()
+	setStreamInfo(stream, &streamInfo{Kind: "http", User: rt.user, Source: r.RemoteAddr, Dest: dest.String(), client: conn})
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	// pass on anything the client sent before it saw the response
+	if n := bufrw.Reader.Buffered(); n > 0 {
+		buffered, _ := bufrw.Reader.Peek(n)
+		if _, err := stream.Write(buffered); err != nil {
+			return
+		}
+	}
+	splice(stream, stream, conn)
+}
+
+// connect opens a connection to dest for rt, subject to the access control
+// list in use.
+func (p *httpProxy) connect(rt route, dest statute.AddrSpec) (net.Conn, statute.Reply, error) {
+	rules := p.server.settings().rules
+	if !allowedAnyAgent(slog.Default(), rules, rt.user, dest) {
+		rep := statute.Reply{Version: statute.VersionSocks5, Response: statute.RepRuleFailure}
+		return nil, rep, &replyError{dest, rep.Response}
+	}
+	return p.server.agents.connect(rt.agent, dest, func(a *Agent, stream net.Conn) bool {
+		return allowedOnStream(slog.Default(), rules, rt.user, a, stream, dest)
+	})
+}
+
+// RoundTrip implements http.RoundTripper, sending absolute-URI requests
+// through the agent named in their context. Each route gets its own
+// http.Transport so that pooled connections are never shared across agents,
+// or between users the access control list may treat differently.
+func (p *httpProxy) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt, _ := r.Context().Value(routeContextKey{}).(route)
+	return p.transport(rt).RoundTrip(r)
+}
+
+// transport returns the http.Transport of rt, dropping those of routes that
+// have not been used for a while or, if there are too many, the route used
+// least recently.
+func (p *httpProxy) transport(rt route) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if t, ok := p.transports[rt]; ok {
+		t.lastUsed = now
+		return t.Transport
+	}
+
+	var oldest route
+	var oldestT *routeTransport
+	for other, t := range p.transports {
+		if now.Sub(t.lastUsed) > transportIdleTimeout {
+			t.CloseIdleConnections()
+			delete(p.transports, other)
+		} else if oldestT == nil || t.lastUsed.Before(oldestT.lastUsed) {
+			oldest, oldestT = other, t
+		}
+	}
+	if len(p.transports) >= maxTransports {
+		oldestT.CloseIdleConnections()
+		delete(p.transports, oldest)
+	}
+
+	t := &routeTransport{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dest, err := statute.ParseAddrSpec(addr)
+				if err != nil {
+					return nil, err
+				}
+				stream, _, err := p.connect(rt, dest)
+				if err != nil {
+					return nil, err
+				}
+				// pooled, so the stream is not tied to one client
+				setStreamInfo(stream, &streamInfo{Kind: "http", User: rt.user, Dest: dest.String()})
+				return stream, nil
+			},
+			MaxIdleConns:    100,
+			IdleConnTimeout: transportIdleTimeout,
+		},
+		lastUsed: now,
+	}
+	p.transports[rt] = t
+	return t.Transport
+}
+
+// closeIdleConnections closes the pooled connections of every route.
+func (p *httpProxy) closeIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// serveError is the ReverseProxy error handler.
+func (p *httpProxy) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	rt, _ := r.Context().Value(routeContextKey{}).(route)
+	slog.Warn("HTTP request failed", "client", r.RemoteAddr, "user", rt.user, "dest", r.URL.Host, "err", err)
+	w.WriteHeader(httpStatus(err))
+}
+
+// httpStatus maps an error from tunnelling a request to an HTTP status.
+func httpStatus(err error) int {
+	if errors.Is(err, errNoAgent) {
+		return http.StatusServiceUnavailable
+	}
+	var replyErr *replyError
+	if errors.As(err, &replyErr) {
+		switch replyErr.Reply {
+		case statute.RepRuleFailure:
+			return http.StatusForbidden
+		case statute.RepTTLExpired:
+			return http.StatusGatewayTimeout
+		}
+	}
+	return http.StatusBadGateway
+}
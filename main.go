@@ -1,187 +1,457 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/Acebond/ReverseSocks5/acl"
 	"github.com/Acebond/ReverseSocks5/bufferpool"
 	"github.com/Acebond/ReverseSocks5/mux"
 	"github.com/Acebond/ReverseSocks5/statute"
 )
 
-var (
-	bufferPool  = bufferpool.NewPool(math.MaxUint16)
-	magicPacket = [64]byte{
-		0x6a, 0x1d, 0x3e, 0x74, 0x8b, 0x99, 0x5a, 0x7f,
-		0xca, 0xef, 0x33, 0x88, 0xac, 0x44, 0x52, 0xbd,
-		0x1e, 0x5f, 0x39, 0xd4, 0x6c, 0xb3, 0x72, 0xf8,
-		0x21, 0x9d, 0x54, 0x68, 0x91, 0xab, 0x43, 0xee,
-		0x4c, 0x7a, 0x90, 0x26, 0xf7, 0x35, 0x9b, 0x5e,
-		0xd1, 0x88, 0x4f, 0xbc, 0x2a, 0x67, 0x91, 0xe4,
-		0xaf, 0x34, 0xcd, 0x89, 0x60, 0x18, 0xa2, 0xde,
-		0x77, 0x93, 0xfb, 0x02, 0x6e, 0x11, 0xc3, 0xf0,
+var bufferPool = bufferpool.NewPool(math.MaxUint16)
+
+// Options are the settings from the command line and configuration file.
+type Options struct {
+	Server      ServerConfig
+	PSK         string
+	Connect     string
+	ConnectTLS  bool
+	PolicyFile  string
+	Name        string
+	Backoff     Backoff
+	Dial        DialConfig
+	Metrics     string
+	Log         LogConfig
+	ConfigFile  string
+	CheckConfig bool
+}
+
+// loadOptions parses the command line arguments, followed by the
+// configuration file they name. The flags are returned along with any error
+// from the configuration file.
+func loadOptions(args []string, errorHandling flag.ErrorHandling) (*Options, error) {
+	var o Options
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	fs.StringVar(&o.Server.AgentListen, "listen", ":10443", "Listen address for socks agents address:port")
+	fs.StringVar(&o.Server.SocksListen, "socks", "127.0.0.1:1080", "Listen address for socks server address:port")
+	fs.StringVar(&o.PSK, "psk", "password", "Pre-shared key for encryption and authentication between the agent and server")
+	fs.StringVar(&o.Connect, "connect", "", "Connect address for socks agent address:port")
+	fs.BoolVar(&o.ConnectTLS, "tls", false, "Connect with TLS instead of TCP, the server must be using certificates")
+	fs.StringVar(&o.PolicyFile, "policy", "", "Destination policy file of allow and deny rules the socks agent enforces, after the rules built into it")
+	fs.StringVar(&o.Name, "name", "", "Name the socks agent registers with, used to select it with a SOCKS5 username of user@name (default hostname)")
+	fs.StringVar(&o.Server.Username, "username", "", "Username used for SOCKS5 authentication")
+	fs.StringVar(&o.Server.Password, "password", "", "Password used for SOCKS5 authentication. No authentication required if not configured.")
+	fs.StringVar(&o.Server.UsersFile, "users", "", "Credentials file of user:hash lines with bcrypt or argon2id hashes. Replaces -username and -password.")
+	fs.StringVar(&o.Server.ACLFile, "acl", "", "Access control list file of allow and deny rules for the destinations socks and http clients may reach")
+	fs.StringVar(&o.Server.CertFile, "cert", "", "Certificate file if using TLS on the server")
+	fs.StringVar(&o.Server.KeyFile, "key", "", "Private key file if using TLS on the server")
+	fs.DurationVar(&o.Server.AgentWait, "agent-wait", 0, "Time a SOCKS5 client waits for an agent to connect when none is available, 0 to fail immediately")
+	fs.StringVar(&o.Server.HTTPListen, "http", "", "Listen address for an HTTP proxy server address:port, disabled if not configured")
+	fs.StringVar(&o.Server.AdminListen, "admin", "", "Listen address for the admin API address:port, must be a loopback address unless -admin-token is set, disabled if not configured")
+	fs.StringVar(&o.Server.AdminToken, "admin-token", "", "Bearer token required by the admin API")
+	fs.StringVar(&o.Server.AuditFile, "audit", "", "Append a JSON Lines audit record of every connection through the agents to this file")
+	fs.BoolVar(&o.Server.AuditChain, "audit-chain", false, "Chain the audit records, each holds the SHA-256 of the one before it")
+	fs.Var(&o.Server.Forwards, "forward", "Port forward [agent@]listen=dest, the server listens on address:port and the agent connects to address:port for each connection (repeatable)")
+	fs.Var(&o.Server.ReverseForwards, "rforward", "Reverse port forward [agent@]listen=dial, the agent listens on address:port and the server dials address:port for each connection (repeatable)")
+
+	fs.DurationVar(&o.Backoff.Min, "retry-min", time.Second, "Delay before the socks agent first tries to reconnect to the server")
+	fs.DurationVar(&o.Backoff.Max, "retry-max", time.Minute, "Maximum delay between socks agent reconnection attempts")
+	fs.Float64Var(&o.Backoff.Jitter, "retry-jitter", 0.2, "Fraction of the reconnection delay that is randomised, between 0 and 1")
+	fs.IntVar(&o.Backoff.Attempts, "retry-attempts", 0, "Consecutive failed reconnection attempts before the socks agent gives up, 0 for no limit")
+	fs.DurationVar(&o.Backoff.Deadline, "retry-deadline", 0, "Time without a connection before the socks agent gives up, 0 for no limit")
+
+	fs.Var(&o.Dial.Servers, "dns", "DNS server address[:port] the socks agent resolves destinations with instead of the system's (repeatable)")
+	fs.BoolVar(&o.Dial.TCP, "dns-tcp", false, "Query the DNS servers over TCP instead of UDP")
+	fs.StringVar(&o.Dial.DoH, "dns-doh", "", "DNS over HTTPS URL the socks agent resolves destinations with, such as https://1.1.1.1/dns-query")
+	fs.DurationVar(&o.Dial.CacheTTL, "dns-cache", time.Minute, "Time the socks agent caches DNS answers, 0 to not cache them")
+	fs.DurationVar(&o.Dial.NegativeTTL, "dns-cache-negative", 5*time.Second, "Time the socks agent caches names that do not exist")
+	fs.Var(&o.Dial.Prefer, "prefer", "Address family the socks agent connects to first, ipv4 or ipv6, the other is tried alongside if it is slow (default the resolver's order)")
+	fs.DurationVar(&o.Dial.Timeout, "dial-timeout", 30*time.Second, "Time the socks agent has to resolve and connect to a destination, 0 for no limit")
+
+	fs.StringVar(&o.Metrics, "metrics", "", "Listen address for Prometheus metrics on /metrics address:port, disabled if not configured")
+	fs.StringVar(&o.Log.File, "log", "", "Append the log to this file instead of writing it to stderr")
+	o.Log.Format = "text"
+	fs.Var(&o.Log.Format, "log-format", "Log format, text or json")
+	fs.TextVar(&o.Log.Level, "log-level", slog.LevelInfo, "Least severe messages logged, debug, info, warn or error")
+	fs.Int64Var(&o.Log.MaxSize, "log-max-size", 0, "Size in megabytes the log file is rotated at, 0 to never rotate it")
+	fs.IntVar(&o.Log.MaxFiles, "log-max-files", 5, "Rotated log files kept")
+	fs.StringVar(&o.ConfigFile, "config", "", "JSON configuration file of flag names and values, flags on the command line take precedence. The server reloads it and the files it names on SIGHUP.")
+	fs.BoolVar(&o.CheckConfig, "check-config", false, "Check the configuration, including the files it names, and exit")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
 	}
-)
+	o.Server.PSK, o.Server.MetricsListen = o.PSK, o.Metrics
+	if o.ConfigFile != "" {
+		if err := loadConfigFile(fs, o.ConfigFile); err != nil {
+			return &o, err
+		}
+		o.Server.PSK, o.Server.MetricsListen = o.PSK, o.Metrics
+	}
+	return &o, nil
+}
 
 func main() {
 	const version = "v2.2.0"
-	log.Printf("ReverseSocks5 %v\n", version)
 
-	listen := flag.String("listen", ":10443", "Listen address for socks agents address:port")
-	socks := flag.String("socks", "127.0.0.1:1080", "Listen address for socks server address:port")
-	psk := flag.String("psk", "password", "Pre-shared key for encryption and authentication between the agent and server")
-	connect := flag.String("connect", "", "Connect address for socks agent address:port")
-	connectTLS := flag.Bool("tls", false, "Connect with TLS instead of TCP, the server must be using certificates")
-	username := flag.String("username", "", "Username used for SOCKS5 authentication")
-	password := flag.String("password", "", "Password used for SOCKS5 authentication. No authentication required if not configured.")
-	cert := flag.String("cert", "", "Certificate file if using TLS on the server")
-	key := flag.String("key", "", "Private key file if using TLS on the server")
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	flag.Parse()
+	opts, err := loadOptions(os.Args[1:], flag.ExitOnError)
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	// configuration errors are printed plainly when checking
+	fatal := func(msg string) { logFatal(msg) }
+	if opts.CheckConfig {
+		fatal = func(msg string) {
+			fmt.Fprintln(os.Stderr, msg)
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if !opts.CheckConfig {
+		if err := setupLogging(opts.Log); err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("ReverseSocks5 " + version)
+	}
 
-	if *connect == "" {
-		ReverseSocksServer(*listen, *socks, *psk, *cert, *key, *username, *password)
+	if opts.Connect == "" {
+		if opts.CheckConfig {
+			if _, err := loadServerSettings(opts.Server); err != nil {
+				fatal(err.Error())
+			}
+			fmt.Println("Configuration OK")
+			return
+		}
+		ReverseSocksServer(opts.Server, func() (ServerConfig, error) {
+			opts, err := loadOptions(os.Args[1:], flag.ContinueOnError)
+			if err != nil {
+				return ServerConfig{}, err
+			}
+			return opts.Server, nil
+		})
 	} else {
-		ReverseSocksAgent(*connect, *psk, *connectTLS)
+		if opts.Name == "" {
+			opts.Name, _ = os.Hostname()
+		}
+		policy, err := loadPolicy(opts.PolicyFile)
+		if err != nil {
+			fatal(err.Error())
+		}
+		dialer, err := newDestDialer(opts.Dial)
+		if err != nil {
+			fatal(err.Error())
+		}
+		if opts.CheckConfig {
+			fmt.Println("Configuration OK")
+			return
+		}
+		ReverseSocksAgent(opts.Connect, opts.PSK, opts.Name, opts.ConnectTLS, opts.Backoff, policy, dialer, opts.Metrics)
 	}
 }
 
-// Start a socks5 server and tunnel the traffic to the server at address.
-func ReverseSocksAgent(serverAddress, psk string, useTLS bool) {
-	log.Println("Connecting to socks server at " + serverAddress)
+// maxServerHangUps is how many hellos in a row the server may hang up on
+// before the agent gives up, as it most likely uses another pre-shared key.
+const maxServerHangUps = 10
+
+// Start a socks5 server and tunnel the traffic to the server at address,
+// reconnecting whenever the connection to the server is lost. Metrics are
+// served on metricsListen, if it is not empty.
+func ReverseSocksAgent(serverAddress, psk, name string, useTLS bool, backoff Backoff, policy *acl.List, dialer *destDialer, metricsListen string) {
+	attempt := 0
+	lastConnected := time.Now()
+
+	var session atomic.Pointer[mux.Mux]
+	if metricsListen != "" {
+		ln, err := net.Listen("tcp", metricsListen)
+		if err != nil {
+			logFatal(err.Error())
+		}
+		go serveMetrics(ln, agentMetrics(&session))
+	}
+
+	hangUps := 0
+	for {
+		connected, err := runAgent(serverAddress, psk, name, useTLS, policy, dialer, &session)
+		if errors.Is(err, ErrAgentAuthFailed) || errors.Is(err, ErrUnsupportedProtocol) {
+			// retrying will not change the server's mind
+			logFatal(err.Error(), "server", serverAddress)
+		}
+		// a server restarting or a middlebox may hang up too, but not every
+		// time
+		if errors.Is(err, ErrServerHungUp) {
+			hangUps++
+		} else {
+			hangUps = 0
+		}
+		if hangUps >= maxServerHangUps {
+			logFatal("Giving up after the server hung up on every hello", "server", serverAddress, "attempts", hangUps, "err", err)
+		}
+		if err != nil {
+			slog.Warn("Lost the connection to the server", "server", serverAddress, "err", err)
+		}
+		if connected {
+			attempt = 0
+			lastConnected = time.Now()
+		}
+		attempt++
+
+		if backoff.Attempts > 0 && attempt > backoff.Attempts {
+			logFatal("Giving up after too many failed attempts to connect", "attempts", backoff.Attempts)
+		}
+		if backoff.Deadline > 0 && time.Since(lastConnected) > backoff.Deadline {
+			logFatal("Giving up after too long without a connection", "deadline", backoff.Deadline)
+		}
+
+		delay := backoff.delay(attempt)
+		slog.Info("Reconnecting", "delay", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// runAgent connects to the server and serves socks requests until the
+// connection is lost. It reports whether the connection was established. The
+// mux is kept in current while it runs.
+func runAgent(serverAddress, psk, name string, useTLS bool, policy *acl.List, dialer *destDialer, current *atomic.Pointer[mux.Mux]) (bool, error) {
+	logger := slog.With("server", serverAddress)
+	logger.Info("Connecting to socks server")
 
 	var conn net.Conn
 	var err error
 
+	serverDialer := &net.Dialer{Timeout: 30 * time.Second}
 	if useTLS {
-		conn, err = tls.Dial("tcp", serverAddress, nil)
+		conn, err = tls.DialWithDialer(serverDialer, "tcp", serverAddress, nil)
 	} else {
-		conn, err = net.Dial("tcp", serverAddress)
+		conn, err = serverDialer.Dial("tcp", serverAddress)
 	}
 
 	if err != nil {
-		log.Fatalln(err.Error())
+		return false, err
 	}
 
-	_, err = conn.Write(magicPacket[:])
-	if err != nil {
-		log.Fatalln(err.Error())
+	if err := agentHandshake(conn, psk, name); err != nil {
+		conn.Close()
+		return false, err
 	}
 
-	log.Println("Connected")
+	session, err := mux.Server(conn, psk, logger)
+	if err != nil {
+		return false, err
+	}
 
-	session := mux.Server(conn, psk)
+	logger.Info("Connected")
+	current.Store(session)
+	defer current.Store(nil)
 
+	socksServer := NewSocksServer(session, policy, dialer, logger)
+	var wg sync.WaitGroup
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Println(err.Error())
+			logger.Info("Disconnected", "err", err)
 			break
 		}
+		wg.Add(1)
 		go func() {
-			// Note ServeConn() will take overship of stream and close it.
-			if err := ServeConn(stream); err != nil && err != mux.ErrPeerClosedStream {
-				log.Println(err.Error())
-			}
+			defer wg.Done()
+			// Note ServeConn() will take overship of stream and close it, and
+			// logs its own errors.
+			socksServer.ServeConn(stream) //nolint: errcheck
 		}()
 	}
 
+	// Closing the mux fails every stream, wait for them to wind down so
+	// nothing from this session outlives it.
 	session.Close()
+	wg.Wait()
+	return true, nil
 }
 
-func ReverseSocksServer(agentListenAddress, socksListenAddress, psk, certFile, keyFile, username, password string) {
-	usingTLS := false
-	var cert tls.Certificate
-	var err error
+// ServerConfig holds the settings of the reverse socks server.
+type ServerConfig struct {
+	AgentListen     string
+	SocksListen     string
+	HTTPListen      string
+	PSK             string
+	CertFile        string
+	KeyFile         string
+	Username        string
+	Password        string
+	UsersFile       string
+	ACLFile         string
+	AgentWait       time.Duration
+	AdminListen     string
+	AdminToken      string
+	MetricsListen   string
+	AuditFile       string
+	AuditChain      bool
+	Forwards        localForwards
+	ReverseForwards reverseForwards
+}
 
-	if certFile != "" && keyFile != "" {
-		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+// serverSettings is a loaded server configuration, including the parts that
+// come from other files. Reloading swaps it as a whole.
+type serverSettings struct {
+	config ServerConfig
+	// clients must authenticate if auth is not nil
+	auth  *UserPassAuthenticator
+	rules *acl.List
+	// agents connect with TCP if tlsConfig is nil
+	tlsConfig *tls.Config
+}
+
+// loadServerSettings loads the users, access control list and certificate
+// the configuration names.
+func loadServerSettings(config ServerConfig) (*serverSettings, error) {
+	s := &serverSettings{config: config}
+
+	switch {
+	case config.CertFile != "" && config.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
 		if err != nil {
-			log.Println("Certificate and/or private key not provided, using TCP listener")
-		} else {
-			usingTLS = true
+			// agents using TLS could not connect if we fell back to TCP
+			return nil, fmt.Errorf("could not load the certificate: %w", err)
 		}
+		s.tlsConfig = &tls.Config{
+			PreferServerCipherSuites: true,
+			CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+			Certificates:             []tls.Certificate{cert},
+		}
+	case config.CertFile != "" || config.KeyFile != "":
+		return nil, errors.New("both a certificate and a private key are needed for TLS")
 	}
 
-	if len(password) == 0 {
-		log.Println("WARNING: No password configured, anyone will be able to connect to the SOCKS5 server.")
+	switch {
+	case config.UsersFile != "" && len(config.Password) > 0:
+		return nil, errors.New("only one of a password and a users file can be configured")
+	case config.UsersFile != "":
+		users, err := newCredentialsFile(config.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = &UserPassAuthenticator{users}
+	case len(config.Password) > 0:
+		s.auth = &UserPassAuthenticator{staticCredentials{config.Username, config.Password}}
 	}
 
-	log.Println("Listening for socks agents on " + agentListenAddress)
+	if config.AdminListen != "" && config.AdminToken == "" {
+		host, _, err := net.SplitHostPort(config.AdminListen)
+		if err != nil {
+			return nil, err
+		}
+		if !isLoopback(host) {
+			return nil, errors.New("the admin API must listen on a loopback address unless an admin token is configured")
+		}
+	}
 
-	var ln net.Listener
-	if usingTLS {
-		config := &tls.Config{
-			PreferServerCipherSuites: true,
-			CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
-			Certificates:             []tls.Certificate{cert},
+	if config.ACLFile != "" {
+		var err error
+		if s.rules, err = acl.Load(config.ACLFile); err != nil {
+			return nil, err
 		}
-		ln, err = tls.Listen("tcp", agentListenAddress, config)
-	} else {
-		ln, err = net.Listen("tcp", agentListenAddress)
 	}
+	return s, nil
+}
 
-	if err != nil {
-		log.Fatalln(err.Error())
+// ReverseSocksServer runs the server until the process exits. On SIGHUP the
+// configuration is read again with load and applied without disturbing the
+// agents that are connected.
+func ReverseSocksServer(config ServerConfig, load func() (ServerConfig, error)) {
+	s := newReverseServer(config.AgentWait, load)
+	if err := s.apply(config); err != nil {
+		logFatal(err.Error())
 	}
-	defer ln.Close()
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err.Error())
-			continue
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := s.reload(); err != nil {
+			slog.Error("Failed to reload the configuration", "err", err)
 		}
+	}
+}
 
-		log.Printf("Agent connected from: %s\n", conn.RemoteAddr().String())
+// serveAgents accepts agent connections until ln is closed.
+func (s *reverseServer) serveAgents(ln net.Listener) {
+	slog.Info("Listening for socks agents", "listen", ln.Addr().String())
+	defer ln.Close()
 
-		deadline := time.Now().Add(time.Second * 5)
-		conn.SetReadDeadline(deadline)
-		buffer := make([]byte, 64)
-		n, err := conn.Read(buffer)
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("Error reading magic packet:", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Failed to accept an agent", "err", err)
 			continue
 		}
-		if n == len(magicPacket) && bytes.Equal(buffer, magicPacket[:]) {
-			log.Println("Agent Connected!")
-		} else {
-			log.Println("Client did not send the magic packet in time")
-			continue
+		// TLS is applied here so that it can be turned on and off by a reload
+		if tlsConfig := s.settings().tlsConfig; tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
 		}
-		conn.SetReadDeadline(time.Time{})
-
-		session := mux.Client(conn, psk)
-		TunnelServer(socksListenAddress, username, password, session)
-		session.Close()
+		go s.handleAgent(conn)
 	}
 }
 
-// Accepts connections and tunnels the traffic to the SOCKS server running on the client.
-func TunnelServer(listenAddress, username, password string, session *mux.Mux) {
-	log.Println("Listening for socks clients on " + listenAddress)
+// handleAgent checks a new agent connection, registers its mux and sets up
+// its reverse port forwards.
+func (s *reverseServer) handleAgent(conn net.Conn) {
+	logger := slog.With("agent_addr", conn.RemoteAddr().String())
+	logger.Debug("Agent connecting")
 
-	ln, err := net.Listen("tcp", listenAddress)
+	psk := s.settings().config.PSK
+	name, err := serverHandshake(conn, psk)
 	if err != nil {
-		log.Fatalln(err.Error())
+		logger.Warn("Rejected agent", "err", err)
+		conn.Close()
+		return
 	}
-	defer ln.Close()
 
-	authMethod := Authenticator(&NoAuthAuthenticator{})
-
-	if len(password) > 0 {
-		authMethod = &UserPassAuthenticator{username, password}
+	session, err := mux.Client(conn, psk, logger)
+	if err != nil {
+		logger.Warn("Agent failed the handshake", "err", err)
+		return
 	}
+	session.OnStreamClosed(s.countUserBytes)
+
+	// a reload either sees the agent or the agent sees the new reverse forwards
+	s.mu.Lock()
+	agent := s.agents.add(name, conn.RemoteAddr(), session, logger)
+	session.OnStreamClosed(func(stream *mux.Stream) { s.auditStream(agent, stream) })
+	agent.log.Info("Agent connected")
+	syncReverseForwards(agent, s.settings().config.ReverseForwards)
+	s.mu.Unlock()
+
+	go serveReverseStreams(agent, s)
+
+	<-session.Done()
+	agent.log.Info("Agent disconnected")
+}
+
+// Accepts connections and tunnels the traffic to the SOCKS server running on
+// one of the connected agents.
+func TunnelServer(ln net.Listener, s *reverseServer) {
+	slog.Info("Listening for socks clients", "listen", ln.Addr().String())
+	defer ln.Close()
 
 	for {
 		conn, err := ln.Accept()
@@ -189,58 +459,134 @@ func TunnelServer(listenAddress, username, password string, session *mux.Mux) {
 			if errors.Is(err, net.ErrClosed) {
 				break
 			} else {
-				log.Println(err.Error())
+				slog.Warn("Failed to accept a socks client", "err", err)
 				continue
 			}
 		}
 
-		stream, err := session.OpenStream()
-		if err != nil {
-			conn.Close()
-			log.Println(err.Error())
-			// This is unrecoverable as the socks server is not opening connections.
-			break
+		// authentication and rules as configured when the client connected
+		settings := s.settings()
+		authMethod := Authenticator(&NoAuthAuthenticator{})
+		if settings.auth != nil {
+			authMethod = settings.auth
 		}
-
-		go handleSocksClient(conn, stream, authMethod)
+		logger := slog.With("client", conn.RemoteAddr().String())
+		go handleSocksClient(conn, s.agents, authMethod, settings.rules, logger)
 
 	}
 }
 
-func doauth(conn net.Conn, authMethod Authenticator) error {
+func doauth(reader io.Reader, writer io.Writer, authMethod Authenticator) (*AuthContext, error) {
 
 	// Check its a really SOCKS5 connection
-	mr, err := statute.ParseMethodRequest(conn)
+	mr, err := statute.ParseMethodRequest(reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if mr.Ver != statute.VersionSocks5 {
-		return statute.ErrNotSupportVersion
+		return nil, statute.ErrNotSupportVersion
 	}
 
 	// Select a usable method
 	for _, method := range mr.Methods {
 		if authMethod.GetCode() == method {
-			return authMethod.Authenticate(conn)
+			return authMethod.Authenticate(reader, writer)
 
 		}
 	}
 
 	// No usable method found
-	conn.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable}) //nolint: errcheck
-	return statute.ErrNoSupportedAuth
+	writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable}) //nolint: errcheck
+	return nil, statute.ErrNoSupportedAuth
 }
 
-func handleSocksClient(conn net.Conn, stream net.Conn, authMethod Authenticator) {
+func handleSocksClient(conn net.Conn, agents *agentRegistry, authMethod Authenticator, rules *acl.List, logger *slog.Logger) {
 	defer conn.Close()
+	bufConn := bufio.NewReader(conn)
+
+	// SOCKS4 clients have no method negotiation, tell them apart by version
+	if version, err := bufConn.Peek(1); err == nil && version[0] == statute.VersionSocks4 {
+		handleSocks4Client(conn, bufConn, agents, authMethod, rules, logger)
+		return
+	}
+
+	authContext, err := doauth(bufConn, conn, authMethod)
+	if err != nil {
+		metrics.authFailures.add("socks5", 1)
+		logger.Warn("Failed to authenticate socks client", "err", err)
+		return
+	}
+	user := authContext.Payload["username"]
+	logger = logger.With("user", user)
+
+	// The request is parsed here rather than on the agent so that commands
+	// needing a socket on the server, like UDP ASSOCIATE, can be served.
+	request, err := statute.ParseRequest(bufConn)
+	if err != nil {
+		if errors.Is(err, statute.ErrUnrecognizedAddrType) {
+			SendReply(conn, statute.RepAddrTypeNotSupported, nil) //nolint: errcheck
+		}
+		logger.Warn("Failed to read request", "err", err)
+		return
+	}
+	logger = logger.With("dest", request.DstAddr.String())
+
+	// Refuse what the access control list denies before waiting for an agent.
+	// For UDP the request only holds the client address, every datagram is
+	// checked instead.
+	associate := request.Command == statute.CommandAssociate
+	if !associate && !allowedAnyAgent(logger, rules, user, request.DstAddr) {
+		SendReply(conn, statute.RepRuleFailure, nil) //nolint: errcheck
+		return
+	}
+
+	// Use the agent named by the SOCKS username, or the default one
+	stream, agent, err := agents.openStream(authContext.Payload["agent"])
+	if err != nil {
+		SendReply(conn, statute.RepNetworkUnreachable, nil) //nolint: errcheck
+		logger.Warn("Failed to open a stream", "err", err)
+		return
+	}
 	defer stream.Close()
+	logger = withStream(logger, agent, stream)
+	logger.Debug("Socks request", "command", request.Command)
+
+	info := &streamInfo{Kind: "socks", User: user, Source: conn.RemoteAddr().String(), Dest: request.DstAddr.String(), client: conn}
+	if associate {
+		info.Kind, info.Dest = "udp", ""
+		// datagrams may be sent to hostnames
+		if !sentStreamRules(logger, rules, user, agent, stream) {
+			info.reply = new(statute.RepRuleFailure)
+		}
+	} else if !allowedOnStream(logger, rules, user, agent, stream, request.DstAddr) {
+		info.reply = new(statute.RepRuleFailure)
+	}
+	setStreamInfo(stream, info)
 
-	if err := doauth(conn, authMethod); err != nil {
-		log.Printf("failed to authenticate: %v", err.Error())
+	if info.reply != nil {
+		SendReply(conn, *info.reply, nil) //nolint: errcheck
 		return
 	}
 
-	// Proxy the data
+	if associate {
+		allow := func(dest statute.AddrSpec) bool { return allowed(logger, rules, user, agent, dest) }
+		if err := handleSocksAssociate(conn, bufConn, stream, request, allow, logger); err != nil {
+			logger.Warn("UDP associate failed", "err", err)
+		}
+		return
+	}
+
+	if _, err := stream.Write(request.Bytes()); err != nil {
+		logger.Warn("Failed to send the request to the agent", "err", err)
+		return
+	}
+	proxyStream(conn, bufConn, stream)
+}
+
+// proxyStream copies data between a client and its stream until the stream
+// ends or both directions are done. Data from the client is read from reader, which may
+// hold bytes already buffered from conn.
+func proxyStream(conn net.Conn, reader io.Reader, stream net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -248,13 +594,14 @@ func handleSocksClient(conn net.Conn, stream net.Conn, authMethod Authenticator)
 		buf := bufferPool.Get()
 		defer bufferPool.Put(buf)
 		io.CopyBuffer(conn, stream, buf[:cap(buf)])
-		// io.Copy(conn, stream)
+		// The agent is done with the stream, so the client is too.
+		conn.Close()
 		wg.Done()
 	}()
 	go func() {
 		buf := bufferPool.Get()
 		defer bufferPool.Put(buf)
-		io.CopyBuffer(stream, conn, buf[:cap(buf)])
+		io.CopyBuffer(stream, reader, buf[:cap(buf)])
 		wg.Done()
 	}()
 
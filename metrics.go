@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Acebond/ReverseSocks5/mux"
+)
+
+// Metrics are served in the Prometheus text format on the -metrics listener,
+// by the server and by the agent alike. Stream and byte counts come from the
+// muxes, everything else is counted here.
+var metrics struct {
+	socksReplies   counterVec // SOCKS5 replies sent with SendReply, by code
+	authFailures   counterVec // by protocol
+	streamFailures counterVec // client requests refused, by reason
+
+	// bytes of the user's streams that have been closed, open streams are
+	// added when scraping
+	userSent     counterVec
+	userReceived counterVec
+}
+
+// A counterVec is a set of counters told apart by a single label.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (c *counterVec) add(label string, n uint64) {
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[label] += n
+	c.mu.Unlock()
+}
+
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for label, n := range c.values {
+		values[label] = n
+	}
+	return values
+}
+
+// countUserBytes adds the bytes of a closed stream to its user's totals.
+func (s *reverseServer) countUserBytes(stream *mux.Stream) {
+	if info, ok := stream.Info().(*streamInfo); ok {
+		user := s.metricsUser(info.User)
+		metrics.userSent.add(user, stream.BytesWritten())
+		metrics.userReceived.add(user, stream.BytesRead())
+	}
+}
+
+// metricsUser returns the user label for user's bytes. Without
+// authentication the username is whatever the client made up, so it is left
+// out rather than adding a label value for every one of them.
+func (s *reverseServer) metricsUser(user string) string {
+	if s.settings().auth == nil {
+		return ""
+	}
+	return user
+}
+
+// A metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// family starts a metric, the samples of which must follow.
+func (w *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value, labels are given as name and value pairs.
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// counters writes a family with one sample for every value, labelled with
+// label.
+func (w *metricsWriter) counters(name, help, label string, values map[string]uint64) {
+	w.family(name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.sample(name, float64(values[k]), label, k)
+	}
+}
+
+// A muxSample is the statistics of one mux and the labels that identify it.
+type muxSample struct {
+	labels []string
+	stats  mux.Stats
+}
+
+// muxMetrics writes the statistics of the muxes, one sample each.
+func (w *metricsWriter) muxMetrics(muxes []muxSample) {
+	each := func(name, kind, help string, value func(mux.Stats) float64) {
+		w.family(name, kind, help)
+		for _, m := range muxes {
+			w.sample(name, value(m.stats), m.labels...)
+		}
+	}
+	each("reversesocks5_streams_open", "gauge", "Streams open on the tunnel.",
+		func(st mux.Stats) float64 { return float64(st.StreamsOpen) })
+	each("reversesocks5_streams_opened_total", "counter", "Streams opened on the tunnel by either side.",
+		func(st mux.Stats) float64 { return float64(st.StreamsOpened) })
+
+	w.family("reversesocks5_bytes_total", "counter", "Bytes sent and received through the tunnel's streams.")
+	for _, m := range muxes {
+		w.sample("reversesocks5_bytes_total", float64(m.stats.BytesWritten), append(m.labels, "direction", "sent")...)
+		w.sample("reversesocks5_bytes_total", float64(m.stats.BytesRead), append(m.labels, "direction", "received")...)
+	}
+
+	each("reversesocks5_write_buffer_bytes", "gauge", "Bytes of frames waiting to be written to the tunnel.",
+		func(st mux.Stats) float64 { return float64(st.WriteBuffered) })
+	each("reversesocks5_write_buffer_size_bytes", "gauge", "Size of the tunnel's write buffer.",
+		func(st mux.Stats) float64 { return float64(st.WriteBufferSize) })
+	each("reversesocks5_write_buffer_waits_total", "counter", "Times a stream waited for room in the tunnel's write buffer.",
+		func(st mux.Stats) float64 { return float64(st.WriteWaits) })
+	each("reversesocks5_keepalive_rtt_seconds", "gauge", "Round trip time of the last keepalive answered on the tunnel.",
+		func(st mux.Stats) float64 { return st.KeepaliveRTT.Seconds() })
+}
+
+// serveMetrics serves h on /metrics until ln is closed.
+func serveMetrics(ln net.Listener, h http.HandlerFunc) {
+	slog.Info("Listening for metrics scrapes", "listen", ln.Addr().String())
+	handler := http.NewServeMux()
+	handler.Handle("GET /metrics", h)
+	http.Serve(ln, handler) //nolint: errcheck
+}
+
+func writeMetrics(rw http.ResponseWriter, w *metricsWriter) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.Write(w.Bytes()) //nolint: errcheck
+}
+
+// serverMetrics is the /metrics handler of the server.
+func (s *reverseServer) serverMetrics(rw http.ResponseWriter, r *http.Request) {
+	var w metricsWriter
+	agents := s.agents.list()
+
+	w.family("reversesocks5_agents_connected", "gauge", "Agents connected to the server.")
+	w.sample("reversesocks5_agents_connected", float64(len(agents)))
+
+	var muxes []muxSample
+	userSent, userReceived := metrics.userSent.snapshot(), metrics.userReceived.snapshot()
+	for _, a := range agents {
+		muxes = append(muxes, muxSample{
+			labels: []string{"agent", a.Name, "id", strconv.FormatUint(a.ID, 10)},
+			stats:  a.session.Stats(),
+		})
+		for _, stream := range a.session.Streams() {
+			if info, ok := stream.Info().(*streamInfo); ok {
+				user := s.metricsUser(info.User)
+				userSent[user] += stream.BytesWritten()
+				userReceived[user] += stream.BytesRead()
+			}
+		}
+	}
+	w.muxMetrics(muxes)
+
+	w.family("reversesocks5_user_bytes_total", "counter", "Bytes sent to and received from agents for each authenticated user.")
+	users := make([]string, 0, len(userSent))
+	for user := range userSent {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		w.sample("reversesocks5_user_bytes_total", float64(userSent[user]), "user", user, "direction", "sent")
+		w.sample("reversesocks5_user_bytes_total", float64(userReceived[user]), "user", user, "direction", "received")
+	}
+
+	w.counters("reversesocks5_stream_failures_total", "Client requests refused by the server, by reason.", "reason", metrics.streamFailures.snapshot())
+	w.counters("reversesocks5_auth_failures_total", "Clients that failed to authenticate.", "protocol", metrics.authFailures.snapshot())
+	w.counters("reversesocks5_socks_replies_total", "SOCKS5 replies sent by the server, by reply code.", "code", metrics.socksReplies.snapshot())
+	writeMetrics(rw, &w)
+}
+
+// agentMetrics returns the /metrics handler of an agent, session holds its
+// current connection to the server.
+func agentMetrics(session *atomic.Pointer[mux.Mux]) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var w metricsWriter
+		w.family("reversesocks5_connected", "gauge", "Whether the agent is connected to the server.")
+		var muxes []muxSample
+		if m := session.Load(); m != nil {
+			muxes = append(muxes, muxSample{stats: m.Stats()})
+			w.sample("reversesocks5_connected", 1)
+		} else {
+			w.sample("reversesocks5_connected", 0)
+		}
+		w.muxMetrics(muxes)
+		w.counters("reversesocks5_socks_replies_total", "SOCKS5 replies sent by the agent, by reply code.", "code", metrics.socksReplies.snapshot())
+		writeMetrics(rw, &w)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Acebond/ReverseSocks5/mux"
+)
+
+// muxPair returns a client and a server Mux connected over loopback TCP.
+func muxPair(t *testing.T) (client, server *mux.Mux) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			server, err = mux.Server(conn, "test psk", nil)
+		}
+		done <- err
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client, err = mux.Client(conn, "test psk", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// scrape serves h on a local listener and returns the body of a GET
+// /metrics, after checking the response is in the Prometheus text format.
+func scrape(t *testing.T, h http.HandlerFunc) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveMetrics(ln, h)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("scrape returned Content-Type %q, want the text format", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExposition(t, string(body))
+	return string(body)
+}
+
+var (
+	metricName   = `[a-zA-Z_:][a-zA-Z0-9_:]*`
+	helpLine     = regexp.MustCompile(`^# HELP (` + metricName + `) \S.*$`)
+	typeLine     = regexp.MustCompile(`^# TYPE (` + metricName + `) (counter|gauge)$`)
+	sampleLine   = regexp.MustCompile(`^(` + metricName + `)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*")*\})? (\S+)$`)
+	counterValue = regexp.MustCompile(`^[0-9]`)
+)
+
+// checkExposition checks that body is well formed: every family has a HELP
+// and then a TYPE line, each family appears once, and every sample belongs to
+// the family before it and has a valid value.
+func checkExposition(t *testing.T, body string) {
+	t.Helper()
+	if !strings.HasSuffix(body, "\n") {
+		t.Error("exposition does not end with a newline")
+	}
+	seen := make(map[string]bool)
+	var family, kind, help string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if m := helpLine.FindStringSubmatch(line); m != nil {
+			if seen[m[1]] {
+				t.Errorf("line %d: family %s appears twice", lineNo, m[1])
+			}
+			seen[m[1]] = true
+			family, kind, help = "", "", m[1]
+			continue
+		}
+		if m := typeLine.FindStringSubmatch(line); m != nil {
+			if m[1] != help {
+				t.Errorf("line %d: TYPE of %s does not follow its HELP", lineNo, m[1])
+			}
+			family, kind = m[1], m[2]
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("line %d: malformed line %q", lineNo, line)
+			continue
+		}
+		if m[1] != family {
+			t.Errorf("line %d: sample of %s in family %q", lineNo, m[1], family)
+		}
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("line %d: invalid value %q", lineNo, m[3])
+		}
+		if kind == "counter" && (!counterValue.MatchString(m[3]) || value < 0) {
+			t.Errorf("line %d: counter %s has value %s", lineNo, m[1], m[3])
+		}
+	}
+}
+
+// hasSample reports whether body has the sample line want.
+func hasSample(body, want string) bool {
+	for _, line := range strings.Split(body, "\n") {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := &reverseServer{agents: newAgentRegistry(0)}
+	s.current.Store(&serverSettings{auth: &UserPassAuthenticator{Credentials: staticCredentials{"alice", "secret"}}})
+
+	agentSide, serverSide := muxPair(t)
+	a := s.agents.add(`office "east"`, nil, serverSide, slog.Default())
+	defer s.agents.remove(a)
+
+	go func() {
+		stream, err := agentSide.AcceptStream()
+		if err == nil {
+			io.Copy(stream, stream)
+		}
+	}()
+	stream, err := serverSide.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	setStreamInfo(stream, &streamInfo{Kind: "socks5", User: "alice\nadmin"})
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	metrics.authFailures.add("socks5", 1)
+
+	body := scrape(t, s.serverMetrics)
+	for _, want := range []string{
+		`reversesocks5_agents_connected 1`,
+		`reversesocks5_streams_open{agent="office \"east\"",id="1"} 1`,
+		`reversesocks5_user_bytes_total{user="alice\nadmin",direction="sent"} 5`,
+		`reversesocks5_user_bytes_total{user="alice\nadmin",direction="received"} 5`,
+	} {
+		if !hasSample(body, want) {
+			t.Errorf("scrape is missing %s\n%s", want, body)
+		}
+	}
+	if !strings.Contains(body, `reversesocks5_auth_failures_total{protocol="socks5"} `) {
+		t.Errorf("scrape is missing the socks5 auth failures\n%s", body)
+	}
+}
+
+func TestAgentMetrics(t *testing.T) {
+	var session atomic.Pointer[mux.Mux]
+	h := agentMetrics(&session)
+
+	if body := scrape(t, h); !hasSample(body, "reversesocks5_connected 0") {
+		t.Errorf("disconnected agent scrape is missing reversesocks5_connected 0\n%s", body)
+	}
+
+	client, _ := muxPair(t)
+	session.Store(client)
+	body := scrape(t, h)
+	for _, want := range []string{
+		"reversesocks5_connected 1",
+		"reversesocks5_streams_open 0",
+		`reversesocks5_bytes_total{direction="sent"} 0`,
+	} {
+		if !hasSample(body, want) {
+			t.Errorf("scrape is missing %s\n%s", want, body)
+		}
+	}
+}
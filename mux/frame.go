@@ -2,7 +2,6 @@ package mux
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,45 +10,59 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// Every frame carries a sequence number, counting up from zero separately in
+// each direction. It doubles as the AEAD nonce, which is safe as each
+// direction of each session has its own key, and it is authenticated as part
+// of the header, so a replayed, dropped or reordered frame is detected.
 type frameHeader struct {
 	id     uint32
 	length uint16
 	flags  uint16
-	nonce  [chacha20poly1305.NonceSizeX]byte
+	seq    uint64
 }
 
 const (
-	frameHeaderSize = 4 + 2 + 2 + chacha20poly1305.NonceSizeX // must be exact frameHeader struct size
+	frameHeaderSize = 4 + 2 + 2 + 8 // must be exact frameHeader struct size
 	maxPayloadSize  = math.MaxUint16
 )
 
 const (
-	flagData        = iota + 1 // data frame
-	flagKeepalive              // empty frame to keep connection open
-	flagOpenStream             // first frame in stream
-	flagCloseStream            // stream is being closed gracefully
-	flagCloseMux               // mux is being closed gracefully
+	flagData         = iota + 1 // data frame
+	flagKeepalive               // empty frame to keep connection open
+	flagOpenStream              // first frame in stream
+	flagCloseStream             // stream is being closed gracefully
+	flagCloseMux                // mux is being closed gracefully
+	flagWindowUpdate            // peer may send more data, payload is the increment
+	flagKeepaliveAck            // answers a keepalive, to measure the round trip time
+	flagReport                  // out of band report on a stream, opaque to the mux
 )
 
 func encodeFrameHeader(buf []byte, h frameHeader) {
 	binary.LittleEndian.PutUint32(buf[0:], h.id)
 	binary.LittleEndian.PutUint16(buf[4:], h.length)
 	binary.LittleEndian.PutUint16(buf[6:], h.flags)
-	copy(buf[8:], h.nonce[:])
+	binary.LittleEndian.PutUint64(buf[8:], h.seq)
 }
 
 func decodeFrameHeader(buf []byte) frameHeader {
-	h := frameHeader{
+	return frameHeader{
 		id:     binary.LittleEndian.Uint32(buf[0:]),
 		length: binary.LittleEndian.Uint16(buf[4:]),
 		flags:  binary.LittleEndian.Uint16(buf[6:]),
+		seq:    binary.LittleEndian.Uint64(buf[8:]),
 	}
-	copy(h.nonce[:], buf[8:])
-	return h
 }
 
-// nextFrame reads and decrypts a frame from reader
-func readFrame(reader io.Reader, aead cipher.AEAD, frameBuf []byte) (frameHeader, []byte, error) {
+// frameNonce returns the AEAD nonce for the frame with sequence number seq.
+func frameNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce, seq)
+	return nonce
+}
+
+// readFrame reads and decrypts a frame from reader, which must be the frame
+// with sequence number seq.
+func readFrame(reader io.Reader, aead cipher.AEAD, seq uint64, frameBuf []byte) (frameHeader, []byte, error) {
 
 	headerBuf := [frameHeaderSize]byte{}
 
@@ -57,29 +70,29 @@ func readFrame(reader io.Reader, aead cipher.AEAD, frameBuf []byte) (frameHeader
 		return frameHeader{}, nil, fmt.Errorf("could not read frame header: %w", err)
 	}
 	h := decodeFrameHeader(headerBuf[:])
-
-	payloadSize := uint32(chacha20poly1305.Overhead)
-	if h.flags == flagData {
-		payloadSize += uint32(h.length)
+	if h.seq != seq {
+		return frameHeader{}, nil, fmt.Errorf("%w: got %d, expected %d", ErrFrameSequence, h.seq, seq)
 	}
 
+	payloadSize := uint32(chacha20poly1305.Overhead) + uint32(h.length)
+
 	if _, err := io.ReadFull(reader, frameBuf[:payloadSize]); err != nil {
 		return frameHeader{}, nil, fmt.Errorf("could not read frame payload: %w", err)
 	}
 
 	// Decrypt the message and check it wasn't tampered with.
-	if _, err := aead.Open(frameBuf[:0], h.nonce[:], frameBuf[:payloadSize], headerBuf[:]); err != nil {
+	if _, err := aead.Open(frameBuf[:0], frameNonce(h.seq), frameBuf[:payloadSize], headerBuf[:]); err != nil {
 		return frameHeader{}, nil, err
 	}
 
 	return h, frameBuf[:h.length], nil
 }
 
-// appendFrame writs and encrypts a frame to buf
-func appendFrame(buf []byte, aead cipher.AEAD, h frameHeader, payload []byte) []byte {
-	rand.Read(h.nonce[:])
+// appendFrame writs and encrypts a frame with sequence number seq to buf
+func appendFrame(buf []byte, aead cipher.AEAD, seq uint64, h frameHeader, payload []byte) []byte {
+	h.seq = seq
 	frame := buf[len(buf):][:frameHeaderSize+len(payload)+aead.Overhead()]
 	encodeFrameHeader(frame[:frameHeaderSize], h)
-	aead.Seal(frame[frameHeaderSize:][:0], h.nonce[:], payload, frame[:frameHeaderSize])
+	aead.Seal(frame[frameHeaderSize:][:0], frameNonce(seq), payload, frame[:frameHeaderSize])
 	return buf[:len(buf)+len(frame)]
 }
@@ -0,0 +1,314 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const testPSK = "test psk"
+
+// handshakeSize is the number of bytes each side sends during the handshake.
+const handshakeSize = 32 + 32
+
+// tamperPipe connects a client and a server Mux through a relay that passes
+// the handshake and the server's frames through untouched, and hands each of
+// the client's frames to tamper, which returns the frames to send in its place.
+func tamperPipe(t *testing.T, tamper func(frame []byte) [][]byte) (client, server *Mux) {
+	t.Helper()
+	clientConn, relayClient := tcpPipe(t)
+	relayServer, serverConn := tcpPipe(t)
+
+	go func() {
+		io.Copy(relayClient, relayServer)
+		relayClient.Close()
+	}()
+	go func() {
+		defer relayServer.Close()
+		defer relayClient.Close()
+		if _, err := io.CopyN(relayServer, relayClient, handshakeSize); err != nil {
+			return
+		}
+		for {
+			frame, err := readRawFrame(relayClient)
+			if err != nil {
+				return
+			}
+			for _, f := range tamper(frame) {
+				if _, err := relayServer.Write(f); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	type result struct {
+		m   *Mux
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		m, err := Server(serverConn, testPSK, nil)
+		done <- result{m, err}
+	}()
+	client, err := Client(clientConn, testPSK, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		r.m.Close()
+	})
+	return client, r.m
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe,
+// writes are buffered, so a Mux can close gracefully.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+// readRawFrame reads a sealed frame without opening it.
+func readRawFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	h := decodeFrameHeader(frame)
+	frame = append(frame, make([]byte, int(h.length)+chacha20poly1305.Overhead)...)
+	if _, err := io.ReadFull(r, frame[frameHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func frameFlags(frame []byte) uint16 { return decodeFrameHeader(frame).flags }
+
+// withSeq returns a copy of frame claiming to have sequence number seq.
+func withSeq(frame []byte, seq uint64) []byte {
+	frame = append([]byte(nil), frame...)
+	binary.LittleEndian.PutUint64(frame[8:], seq)
+	return frame
+}
+
+// waitDone waits for m to shut down and returns the error it failed with.
+func waitDone(t *testing.T, m *Mux) error {
+	t.Helper()
+	select {
+	case <-m.Done():
+		return m.readErr
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not torn down")
+		return nil
+	}
+}
+
+// openAndWrite opens a stream on client and writes each message to it.
+func openAndWrite(t *testing.T, client *Mux, messages ...string) {
+	t.Helper()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		// the session may already be torn down by the time later messages
+		// are written
+		stream.Write([]byte(msg))
+	}
+}
+
+func TestFrameTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func() func(frame []byte) [][]byte
+		// the error the server fails with, nil for any error that is not
+		// ErrPeerClosedConn
+		want error
+	}{
+		{
+			name: "replayed data",
+			tamper: func() func([]byte) [][]byte {
+				return func(frame []byte) [][]byte {
+					if frameFlags(frame) == flagData {
+						return [][]byte{frame, frame}
+					}
+					return [][]byte{frame}
+				}
+			},
+			want: ErrFrameSequence,
+		},
+		{
+			name: "dropped data",
+			tamper: func() func([]byte) [][]byte {
+				dropped := false
+				return func(frame []byte) [][]byte {
+					if frameFlags(frame) == flagData && !dropped {
+						dropped = true
+						return nil
+					}
+					return [][]byte{frame}
+				}
+			},
+			want: ErrFrameSequence,
+		},
+		{
+			name: "reordered data",
+			tamper: func() func([]byte) [][]byte {
+				var held []byte
+				return func(frame []byte) [][]byte {
+					if frameFlags(frame) != flagData {
+						return [][]byte{frame}
+					}
+					if held == nil {
+						held = frame
+						return nil
+					}
+					return [][]byte{frame, held}
+				}
+			},
+			want: ErrFrameSequence,
+		},
+		{
+			name: "resequenced replay",
+			tamper: func() func([]byte) [][]byte {
+				var seq uint64
+				var last []byte
+				return func(frame []byte) [][]byte {
+					defer func() { seq, last = seq+1, frame }()
+					if frameFlags(frame) == flagData {
+						// the previous frame in this one's place, which the
+						// header's authentication does not allow
+						return [][]byte{withSeq(last, seq)}
+					}
+					return [][]byte{frame}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tamperPipe(t, tt.tamper())
+			openAndWrite(t, client, "first", "second")
+
+			err := waitDone(t, server)
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("server failed with %v, want %v", err, tt.want)
+			}
+			if err == nil || errors.Is(err, ErrPeerClosedConn) {
+				t.Errorf("server failed with %v, want the frame rejected", err)
+			}
+			// the client's session goes down with the connection
+			waitDone(t, client)
+		})
+	}
+}
+
+func TestReplayedOpenStreamAccepted(t *testing.T) {
+	client, server := tamperPipe(t, func(frame []byte) [][]byte {
+		if frameFlags(frame) == flagOpenStream {
+			return [][]byte{frame, frame}
+		}
+		return [][]byte{frame}
+	})
+	openAndWrite(t, client)
+
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(t, server); !errors.Is(err, ErrFrameSequence) {
+		t.Errorf("server failed with %v, want %v", err, ErrFrameSequence)
+	}
+	if s, err := server.AcceptStream(); err == nil {
+		t.Errorf("replayed open accepted stream %d", s.(*Stream).ID())
+	}
+}
+
+// TestReplayedSession replays frames recorded from one session into another,
+// which has its own keys.
+func TestReplayedSession(t *testing.T) {
+	var recorded [][]byte
+	client, server := tamperPipe(t, func(frame []byte) [][]byte {
+		recorded = append(recorded, frame)
+		return [][]byte{frame}
+	})
+	go server.AcceptStream()
+	openAndWrite(t, client, "hello")
+	client.Close()
+	if err := waitDone(t, server); !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatalf("recorded session failed with %v, want %v", err, ErrPeerClosedConn)
+	}
+
+	var closeMux []byte
+	for _, frame := range recorded {
+		if frameFlags(frame) == flagCloseMux {
+			closeMux = frame
+		}
+	}
+	if closeMux == nil {
+		t.Fatal("no close mux frame recorded")
+	}
+
+	tests := []struct {
+		name   string
+		frames func(seq uint64) [][]byte
+	}{
+		{"whole session", func(uint64) [][]byte { return recorded }},
+		{"open stream", func(uint64) [][]byte {
+			for _, frame := range recorded {
+				if frameFlags(frame) == flagOpenStream {
+					return [][]byte{frame}
+				}
+			}
+			t.Fatal("no open stream frame recorded")
+			return nil
+		}},
+		{"close mux", func(uint64) [][]byte { return [][]byte{closeMux} }},
+		{"close mux resequenced", func(seq uint64) [][]byte { return [][]byte{withSeq(closeMux, seq)} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seq uint64
+			injected := false
+			_, server := tamperPipe(t, func(frame []byte) [][]byte {
+				defer func() { seq++ }()
+				if !injected {
+					injected = true
+					return tt.frames(seq)
+				}
+				return [][]byte{frame}
+			})
+			err := waitDone(t, server)
+			if err == nil || errors.Is(err, ErrPeerClosedConn) {
+				t.Errorf("server failed with %v, want the replay rejected", err)
+			}
+			if s, err := server.AcceptStream(); err == nil {
+				t.Errorf("replayed open accepted stream %d", s.(*Stream).ID())
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package mux
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The handshake runs before a Mux starts its loops. Each side sends an
+// ephemeral X25519 public key, and the shared secret is mixed with the
+// pre-shared key to derive one key per direction, so recorded traffic stays
+// safe even if the pre-shared key later leaks. Each side then proves it
+// derived the same keys, which it can only have done knowing the pre-shared
+// key.
+//
+//	client -> server: client public key (32 bytes)
+//	server -> client: server public key (32 bytes)
+//	client -> server: HMAC(client confirm key, transcript) (32 bytes)
+//	server -> client: HMAC(server confirm key, transcript) (32 bytes)
+//
+// Both sides write before they read, the messages are small enough that this
+// cannot deadlock.
+
+const (
+	handshakeTimeout = time.Second * 10
+	handshakeInfo    = "ReverseSocks5 mux v1"
+)
+
+// ErrHandshakeFailed is returned when the peer does not know the pre-shared
+// key.
+var ErrHandshakeFailed = errors.New("handshake failed, peer does not know the pre-shared key")
+
+// handshake performs the key exchange on conn and returns the AEADs used to
+// open frames from and seal frames to the peer.
+func handshake(conn net.Conn, psk string, client bool) (readAEAD, writeAEAD cipher.AEAD, err error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// exchange public keys
+	localPub := priv.PublicKey().Bytes()
+	if _, err := conn.Write(localPub); err != nil {
+		return nil, nil, fmt.Errorf("could not send handshake: %w", err)
+	}
+	remotePub := make([]byte, len(localPub))
+	if _, err := io.ReadFull(conn, remotePub); err != nil {
+		return nil, nil, fmt.Errorf("could not read handshake: %w", err)
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(remotePub)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		// low order point
+		return nil, nil, ErrHandshakeFailed
+	}
+
+	// the transcript is the client's public key followed by the server's
+	transcript := append(localPub, remotePub...)
+	if !client {
+		transcript = append(remotePub, localPub...)
+	}
+
+	salt := blake2b.Sum256([]byte(psk))
+	keys, err := hkdf.Key(sha256.New, shared, salt[:], handshakeInfo+string(transcript), 4*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientKey, serverKey := keys[0:32], keys[32:64]
+	clientConfirm, serverConfirm := keys[64:96], keys[96:128]
+
+	readKey, writeKey := serverKey, clientKey
+	readConfirm, writeConfirm := serverConfirm, clientConfirm
+	if !client {
+		readKey, writeKey = clientKey, serverKey
+		readConfirm, writeConfirm = clientConfirm, serverConfirm
+	}
+
+	// prove we derived the same keys
+	if _, err := conn.Write(transcriptMAC(writeConfirm, transcript)); err != nil {
+		return nil, nil, fmt.Errorf("could not send handshake: %w", err)
+	}
+	peerMAC := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, peerMAC); err != nil {
+		return nil, nil, fmt.Errorf("could not read handshake: %w", err)
+	}
+	if !hmac.Equal(peerMAC, transcriptMAC(readConfirm, transcript)) {
+		return nil, nil, ErrHandshakeFailed
+	}
+
+	readAEAD, _ = chacha20poly1305.New(readKey)
+	writeAEAD, _ = chacha20poly1305.New(writeKey)
+	return readAEAD, writeAEAD, nil
+}
+
+func transcriptMAC(key, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
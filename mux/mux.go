@@ -3,12 +3,13 @@ package mux
 import (
 	"crypto/cipher"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
@@ -27,29 +28,54 @@ var (
 	ErrPeerClosedStream = errors.New("peer closed stream gracefully")
 	ErrPeerClosedConn   = errors.New("peer closed mux gracefully")
 	ErrWriteClosed      = errors.New("write end of stream closed")
+	ErrFrameSequence    = errors.New("frame replayed, dropped or out of order")
+)
+
+// Each side sends a keepalive whenever it has not written anything for
+// keepaliveInterval, so a peer that has been silent for much longer than that
+// is assumed to be gone. Keepalives are answered, and one is also sent every
+// keepaliveInterval on a busy connection, to measure the round trip time.
+const (
+	keepaliveInterval = time.Minute * 4
+	readTimeout       = keepaliveInterval * 2
 )
 
 // A Mux multiplexes multiple duplex Streams onto a single net.Conn.
 type Mux struct {
 	conn       net.Conn
-	aead       cipher.AEAD
+	readAEAD   cipher.AEAD
+	writeAEAD  cipher.AEAD
 	acceptChan chan *Stream
+	done       chan struct{}
+	logger     *slog.Logger
+
+	// statistics, see Stats
+	streamsOpened atomic.Uint64
+	bytesRead     atomic.Uint64
+	bytesWritten  atomic.Uint64
+	keepaliveRTT  atomic.Int64
 
 	readMutex sync.Mutex
 	// subsequent fields are used by readLoop() and guarded by readMutex
-	readErr error
-	streams map[uint32]*Stream
-	nextID  uint32
+	readErr     error
+	streams     map[uint32]*Stream
+	nextID      uint32
+	readSeq     uint64 // only used by readLoop()
+	closedHooks []func(*Stream)
 
 	writeMutex sync.Mutex
 	// subsequent fields are used by writeLoop() and guarded by writeMutex
 	writeErr   error
+	writeSeq   uint64
 	writeCond  sync.Cond
 	bufferCond sync.Cond
 	writeBuf   []byte
 	sendBuf    []byte
 	writeBufA  []byte
 	writeBufB  []byte
+	writeWaits uint64    // times bufferFrame waited for room in writeBuf
+	ackPending bool      // the peer's keepalive is to be answered
+	probeSent  time.Time // when the unanswered keepalive was sent, if any
 }
 
 // setErr sets the Mux error and wakes up all Mux-related goroutines. If m.err
@@ -77,11 +103,15 @@ func (m *Mux) setErr(err error) error {
 		s.err = err
 		s.cond.L.Unlock()
 		s.cond.Broadcast()
+		m.streamClosed(s)
 	}
+	// the streams are done, so they are not reported closed twice
+	m.streams = make(map[uint32]*Stream)
 	m.conn.Close()
 	m.writeCond.Broadcast()
 	m.bufferCond.Broadcast()
 	close(m.acceptChan)
+	close(m.done)
 	return err
 }
 
@@ -91,7 +121,10 @@ func (m *Mux) bufferFrame(h frameHeader, payload []byte) error {
 	m.writeMutex.Lock()
 
 	// block until we can add the frame to the buffer
-	for len(m.writeBuf)+frameHeaderSize+len(payload)+chacha20poly1305.Overhead > cap(m.writeBuf) && m.writeErr == nil {
+	if m.writeBufFull(len(payload)) {
+		m.writeWaits++
+	}
+	for m.writeBufFull(len(payload)) && m.writeErr == nil {
 		m.bufferCond.Wait()
 	}
 	if m.writeErr != nil {
@@ -100,7 +133,8 @@ func (m *Mux) bufferFrame(h frameHeader, payload []byte) error {
 	}
 
 	// queue our frame
-	m.writeBuf = appendFrame(m.writeBuf, m.aead, h, payload)
+	m.writeBuf = appendFrame(m.writeBuf, m.writeAEAD, m.writeSeq, h, payload)
+	m.writeSeq++
 	m.writeMutex.Unlock()
 
 	// wake the writeLoop
@@ -110,20 +144,31 @@ func (m *Mux) bufferFrame(h frameHeader, payload []byte) error {
 	return nil
 }
 
+// controlRoom is kept free in writeBuf for the keepalive and keepalive answer
+// writeLoop may add.
+const controlRoom = 2 * (frameHeaderSize + chacha20poly1305.Overhead)
+
+// writeBufFull reports whether writeBuf has no room for a frame with a
+// payload of the given length. The caller must hold writeMutex.
+func (m *Mux) writeBufFull(length int) bool {
+	return len(m.writeBuf)+frameHeaderSize+length+chacha20poly1305.Overhead+controlRoom > cap(m.writeBuf)
+}
+
 // writeLoop handles the actual Writes to the Mux's net.Conn. It waits for
 // bufferFrame calls to fill m.writeBuf, then flushes the buffer to the
 // underlying connection. It also handles keepalives.
 func (m *Mux) writeLoop() {
 
-	keepaliveInterval := time.Minute * 4
-	nextKeepalive := time.Now().Add(keepaliveInterval)
+	// the first keepalive is sent straight away, to measure the round trip
+	nextKeepalive := time.Now()
+	nextProbe := nextKeepalive
 	timer := time.AfterFunc(keepaliveInterval, m.writeCond.Signal)
 	defer timer.Stop()
 
 	for {
 
 		m.writeMutex.Lock()
-		for len(m.writeBuf) == 0 && m.writeErr == nil && time.Now().Before(nextKeepalive) {
+		for len(m.writeBuf) == 0 && !m.ackPending && m.writeErr == nil && time.Now().Before(nextKeepalive) {
 			m.writeCond.Wait()
 		}
 
@@ -132,12 +177,25 @@ func (m *Mux) writeLoop() {
 			return
 		}
 
+		if m.ackPending {
+			m.writeBuf = appendFrame(m.writeBuf, m.writeAEAD, m.writeSeq, frameHeader{flags: flagKeepaliveAck}, nil)
+			m.writeSeq++
+			m.ackPending = false
+		}
+
 		// if we have a normal frame, use that; otherwise, send a keepalive
 		//
 		// NOTE: even if we were woken by the keepalive timer, there might be a
-		// normal frame ready to send, in which case we don't need a keepalive
-		if len(m.writeBuf) == 0 {
-			m.writeBuf = appendFrame(m.writeBuf[:0], m.aead, frameHeader{flags: flagKeepalive}, nil)
+		// normal frame ready to send, in which case we don't need a keepalive,
+		// unless it is time to measure the round trip again
+		now := time.Now()
+		if len(m.writeBuf) == 0 || !now.Before(nextProbe) {
+			m.writeBuf = appendFrame(m.writeBuf, m.writeAEAD, m.writeSeq, frameHeader{flags: flagKeepalive}, nil)
+			m.writeSeq++
+			if m.probeSent.IsZero() {
+				m.probeSent = now
+			}
+			nextProbe = now.Add(keepaliveInterval)
 		}
 
 		// to avoid blocking bufferFrame while we Write, swap writeBufA and writeBufB
@@ -166,7 +224,27 @@ func (m *Mux) writeLoop() {
 // Delete stream from Mux
 func (m *Mux) deleteStream(id uint32) {
 	m.readMutex.Lock()
-	delete(m.streams, id)
+	if s, ok := m.streams[id]; ok {
+		delete(m.streams, id)
+		m.streamClosed(s)
+	}
+	m.readMutex.Unlock()
+}
+
+// streamClosed runs the hooks for a Stream that is done. The caller must hold
+// readMutex.
+func (m *Mux) streamClosed(s *Stream) {
+	for _, f := range m.closedHooks {
+		f(s)
+	}
+}
+
+// OnStreamClosed arranges for f to be called once for every Stream that is
+// closed by either side or fails with the Mux, after its last byte has been
+// counted. f must not call methods of the Mux.
+func (m *Mux) OnStreamClosed(f func(*Stream)) {
+	m.readMutex.Lock()
+	m.closedHooks = append(m.closedHooks, f)
 	m.readMutex.Unlock()
 }
 
@@ -178,17 +256,31 @@ func (m *Mux) readLoop() {
 	frameBuf := make([]byte, maxPayloadSize+chacha20poly1305.Overhead)
 
 	for {
-		header, payload, err := readFrame(m.conn, m.aead, frameBuf)
+		m.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		header, payload, err := readFrame(m.conn, m.readAEAD, m.readSeq, frameBuf)
 
 		if err != nil {
 			m.setErr(err)
 			return
 		}
+		m.readSeq++
 
 		switch header.flags {
 
 		case flagKeepalive:
-			continue
+			m.writeMutex.Lock()
+			m.ackPending = true
+			m.writeMutex.Unlock()
+			m.writeCond.Signal()
+
+		case flagKeepaliveAck:
+			m.writeMutex.Lock()
+			sent := m.probeSent
+			m.probeSent = time.Time{}
+			m.writeMutex.Unlock()
+			if !sent.IsZero() {
+				m.keepaliveRTT.Store(int64(time.Since(sent)))
+			}
 
 		case flagOpenStream:
 			m.readMutex.Lock()
@@ -206,9 +298,13 @@ func (m *Mux) readLoop() {
 			stream, found := m.streams[header.id]
 			m.readMutex.Unlock()
 			if found {
-				stream.consumeFrame(header, payload)
-			} else {
-				log.Printf("can't find stream ID (%v) (length=%v, flags=%v)", header.id, header.length, header.flags)
+				if err := stream.consumeFrame(header, payload); err != nil {
+					m.setErr(err)
+					return
+				}
+			} else if header.flags != flagWindowUpdate {
+				// window updates for streams we already closed are expected
+				m.logger.Warn("Frame for an unknown stream", "stream", header.id, "length", header.length, "flags", header.flags)
 			}
 		}
 	}
@@ -233,6 +329,60 @@ func (m *Mux) Close() error {
 	return err
 }
 
+// Streams returns the open Streams ordered by ID.
+func (m *Mux) Streams() []*Stream {
+	m.readMutex.Lock()
+	streams := make([]*Stream, 0, len(m.streams))
+	for _, s := range m.streams {
+		streams = append(streams, s)
+	}
+	m.readMutex.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].id < streams[j].id })
+	return streams
+}
+
+// Stats describes the activity of a Mux.
+type Stats struct {
+	StreamsOpen   int    // Streams open now
+	StreamsOpened uint64 // Streams opened or accepted since the Mux started
+	BytesRead     uint64 // bytes received on Streams
+	BytesWritten  uint64 // bytes written to Streams
+
+	WriteBuffered   int    // bytes of frames waiting to be written
+	WriteBufferSize int    // room for frames before writers have to wait
+	WriteWaits      uint64 // times a writer had to wait for room
+
+	// the last round trip time measured with a keepalive, or 0 if none has
+	// been answered yet
+	KeepaliveRTT time.Duration
+}
+
+// Stats returns the current statistics of the Mux.
+func (m *Mux) Stats() Stats {
+	st := Stats{
+		StreamsOpened: m.streamsOpened.Load(),
+		BytesRead:     m.bytesRead.Load(),
+		BytesWritten:  m.bytesWritten.Load(),
+		KeepaliveRTT:  time.Duration(m.keepaliveRTT.Load()),
+	}
+	m.readMutex.Lock()
+	st.StreamsOpen = len(m.streams)
+	m.readMutex.Unlock()
+	m.writeMutex.Lock()
+	st.WriteBuffered = len(m.writeBuf)
+	st.WriteBufferSize = cap(m.writeBuf)
+	st.WriteWaits = m.writeWaits
+	m.writeMutex.Unlock()
+	return st
+}
+
+// Done returns a channel that is closed once the Mux has shut down, either
+// because it was closed or because the underlying connection failed.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
 // AcceptStream waits for and returns the next peer-initiated Stream.
 func (m *Mux) AcceptStream() (net.Conn, error) {
 	if s, ok := <-m.acceptChan; ok {
@@ -257,18 +407,32 @@ func (m *Mux) OpenStream() (net.Conn, error) {
 	return s, m.bufferFrame(h, nil)
 }
 
-// newMux initializes a Mux and spawns its readLoop and writeLoop goroutines.
-func newMux(conn net.Conn, startID uint32, psk string) *Mux {
+// newMux performs the handshake, then initializes a Mux and spawns its
+// readLoop and writeLoop goroutines. The conn is closed if the handshake
+// fails. Problems with the peer's frames are logged to logger, or to
+// slog.Default() if it is nil.
+func newMux(conn net.Conn, startID uint32, psk string, logger *slog.Logger) (*Mux, error) {
+	readAEAD, writeAEAD, err := handshake(conn, psk, startID == 0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	m := &Mux{
 		conn:       conn,
+		readAEAD:   readAEAD,
+		writeAEAD:  writeAEAD,
 		acceptChan: make(chan *Stream, 256),
+		done:       make(chan struct{}),
+		logger:     logger,
 		streams:    make(map[uint32]*Stream),
 		nextID:     startID,
 		writeBufA:  make([]byte, 0, maxPayloadSize*10),
 		writeBufB:  make([]byte, 0, maxPayloadSize*10),
 	}
-	key := blake2b.Sum256([]byte(psk))
-	m.aead, _ = chacha20poly1305.NewX(key[:])
+	if m.logger == nil {
+		m.logger = slog.Default()
+	}
 	m.writeCond.L = &m.writeMutex  // both conds use the same mutex
 	m.bufferCond.L = &m.writeMutex //
 	m.writeBuf = m.writeBufA       // initial writeBuf is writeBufA
@@ -276,17 +440,17 @@ func newMux(conn net.Conn, startID uint32, psk string) *Mux {
 
 	go m.readLoop()
 	go m.writeLoop()
-	return m
+	return m, nil
 }
 
 // Client creates and initializes a new client-side Mux on the provided conn.
 // Client takes overship of the conn.
-func Client(conn net.Conn, psk string) *Mux {
-	return newMux(conn, 0, psk)
+func Client(conn net.Conn, psk string, logger *slog.Logger) (*Mux, error) {
+	return newMux(conn, 0, psk, logger)
 }
 
 // Server creates and initializes a new server-side Mux on the provided conn.
 // Server takes overship of the conn.
-func Server(conn net.Conn, psk string) *Mux {
-	return newMux(conn, 1, psk)
+func Server(conn net.Conn, psk string, logger *slog.Logger) (*Mux, error) {
+	return newMux(conn, 1, psk, logger)
 }
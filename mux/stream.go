@@ -2,34 +2,113 @@ package mux
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Each side of a Stream may buffer up to windowSize bytes that the application
+// has not read yet. The sender may only have that many bytes in flight, and
+// the receiver grants more with a flagWindowUpdate frame once the application
+// has read at least half of it. A slow reader therefore only stalls its own
+// stream, never the Mux's readLoop.
+const windowSize = 1 << 20
+
+// ErrWindowExceeded is returned when the peer sends more data than the stream
+// has room for.
+var ErrWindowExceeded = errors.New("peer exceeded stream receive window")
+
 // A Stream is a duplex connection multiplexed over a net.Conn. It implements
 // the net.Conn interface.
 type Stream struct {
 	mux     *Mux
 	id      uint32
-	cond    sync.Cond // guards + synchronizes subsequent fields
-	err     error
-	readBuf []byte
-	rd, wd  time.Time // deadlines
+	opened  time.Time
+	read    atomic.Uint64 // bytes received from the peer
+	written atomic.Uint64 // bytes accepted by Write
+	info    atomic.Value
+	report  atomic.Pointer[[]byte] // last report from the peer
+
+	cond       sync.Cond // guards + synchronizes subsequent fields
+	err        error
+	readBuf    bytes.Buffer
+	consumed   uint32    // bytes read since the last window update was sent
+	sendWindow uint32    // bytes that may be sent before the peer grants more
+	rd, wd     time.Time // deadlines
 }
 
 func newStream(id uint32, m *Mux) *Stream {
+	m.streamsOpened.Add(1)
 	return &Stream{
-		mux:  m,
-		id:   id,
-		cond: sync.Cond{L: new(sync.Mutex)},
-		err:  m.readErr,
+		mux:        m,
+		id:         id,
+		opened:     time.Now(),
+		cond:       sync.Cond{L: new(sync.Mutex)},
+		err:        m.readErr,
+		sendWindow: windowSize,
 	}
 }
 
+// ID returns the Stream's ID, unique within its Mux while the Stream is open.
+func (s *Stream) ID() uint32 { return s.id }
+
+// Opened returns the time the Stream was opened or accepted.
+func (s *Stream) Opened() time.Time { return s.opened }
+
+// BytesRead returns the number of bytes received on the Stream so far,
+// including those buffered but not yet returned by Read.
+func (s *Stream) BytesRead() uint64 { return s.read.Load() }
+
+// BytesWritten returns the number of bytes written to the Stream so far.
+func (s *Stream) BytesWritten() uint64 { return s.written.Load() }
+
+// SetInfo attaches v to the Stream for the application's own bookkeeping, it
+// is never sent to the peer.
+func (s *Stream) SetInfo(v any) { s.info.Store(&v) }
+
+// Info returns the value last passed to SetInfo, or nil.
+func (s *Stream) Info() any {
+	if v, ok := s.info.Load().(*any); ok {
+		return *v
+	}
+	return nil
+}
+
+// SendReport sends p to the peer out of band, to be returned by the peer
+// Stream's Report method. It does not wait for the peer to have room, and p
+// must fit in a single frame.
+func (s *Stream) SendReport(p []byte) error {
+	if len(p) > maxPayloadSize {
+		return errors.New("report is too large")
+	}
+	s.cond.L.Lock()
+	err := s.err
+	s.cond.L.Unlock()
+	if err != nil {
+		return err
+	}
+	h := frameHeader{
+		id:     s.id,
+		length: uint16(len(p)),
+		flags:  flagReport,
+	}
+	return s.mux.bufferFrame(h, p)
+}
+
+// Report returns the last report the peer sent with SendReport, or nil. It is
+// safe to call from an OnStreamClosed hook.
+func (s *Stream) Report() []byte {
+	if p := s.report.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
 // LocalAddr returns the underlying connection's LocalAddr.
 func (s *Stream) LocalAddr() net.Addr { return s.mux.conn.LocalAddr() }
 
@@ -71,39 +150,61 @@ func (s *Stream) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
-// consumeFrame processes a frame based on h.flags.
-func (s *Stream) consumeFrame(h frameHeader, payload []byte) {
+// consumeFrame processes a frame based on h.flags. It never blocks waiting
+// for the application, data is buffered until Read is called.
+func (s *Stream) consumeFrame(h frameHeader, payload []byte) error {
 	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
 
 	switch h.flags {
 
 	case flagCloseStream:
 		s.err = ErrPeerClosedStream
 		s.mux.deleteStream(s.id)
+		s.cond.Broadcast() // wake Read and Write
 
 	case flagData:
-		s.readBuf = payload
+		if s.err != nil {
+			// nobody will read it
+			return nil
+		}
+		if s.readBuf.Len()+len(payload) > windowSize {
+			return ErrWindowExceeded
+		}
+		s.readBuf.Write(payload)
+		s.read.Add(uint64(len(payload)))
+		s.mux.bytesRead.Add(uint64(len(payload)))
 		s.cond.Broadcast() // wake Read
-		for len(s.readBuf) > 0 && s.err == nil && (s.rd.IsZero() || time.Now().Before(s.rd)) {
-			s.cond.Wait()
+
+	case flagWindowUpdate:
+		if len(payload) != 4 {
+			s.mux.logger.Warn("Peer sent an invalid window update", "stream", h.id, "length", h.length)
+			return nil
 		}
+		s.sendWindow += binary.LittleEndian.Uint32(payload)
+		s.cond.Broadcast() // wake Write
+
+	case flagReport:
+		// payload is reused for the next frame
+		report := bytes.Clone(payload)
+		s.report.Store(&report)
 
 	default:
 		// The flags are mutually exclusive, we should never be here
 		// ignore as the peer sent a bad frame
-		log.Printf("peer sent invalid frame ID (%v) (length=%v, flags=%v)", h.id, h.length, h.flags)
+		s.mux.logger.Warn("Peer sent an invalid frame", "stream", h.id, "length", h.length, "flags", h.flags)
 
 	}
-	s.cond.L.Unlock()
+	return nil
 }
 
 // Read reads data from the Stream.
 func (s *Stream) Read(p []byte) (int, error) {
 	s.cond.L.Lock()
-	defer s.cond.L.Unlock()
 
 	if !s.rd.IsZero() {
 		if !time.Now().Before(s.rd) {
+			s.cond.L.Unlock()
 			return 0, os.ErrDeadlineExceeded
 		}
 		timer := time.AfterFunc(time.Until(s.rd), s.cond.Broadcast)
@@ -111,19 +212,40 @@ func (s *Stream) Read(p []byte) (int, error) {
 	}
 
 	// Wait for data, an error, stream close, or timeout.
-	for len(s.readBuf) == 0 && s.err == nil && (s.rd.IsZero() || time.Now().Before(s.rd)) {
+	for s.readBuf.Len() == 0 && s.err == nil && (s.rd.IsZero() || time.Now().Before(s.rd)) {
 		s.cond.Wait()
 	}
 
 	// A sender could have sent some data then closed the stream. We want to
 	// return the data before indicating the closure of the stream to keep the
 	// order of events correct.
-	if len(s.readBuf) > 0 {
-		n := copy(p, s.readBuf)
-		s.readBuf = s.readBuf[n:]
-		s.cond.Broadcast() // wake consumeFrame
+	if s.readBuf.Len() > 0 {
+		n, _ := s.readBuf.Read(p)
+
+		// Grant the peer more window once half of it has been read. The
+		// frame is sent without holding the lock, so that readLoop can keep
+		// delivering frames to this stream if the write buffer is full.
+		s.consumed += uint32(n)
+		var increment uint32
+		if s.consumed >= windowSize/2 && s.err == nil {
+			increment, s.consumed = s.consumed, 0
+		}
+		s.cond.L.Unlock()
+
+		if increment > 0 {
+			var payload [4]byte
+			binary.LittleEndian.PutUint32(payload[:], increment)
+			h := frameHeader{
+				id:     s.id,
+				length: uint16(len(payload)),
+				flags:  flagWindowUpdate,
+			}
+			// a failure here will be seen by the next Read or Write
+			s.mux.bufferFrame(h, payload[:])
+		}
 		return n, nil
 	}
+	defer s.cond.L.Unlock()
 
 	// Check for errors. There is a very unlikely chance that between leaving
 	// the for loop and checking the deadline it expires. We skip checking the
@@ -140,17 +262,40 @@ func (s *Stream) Read(p []byte) (int, error) {
 
 }
 
-// Write writes data to the Stream.
+// Write writes data to the Stream. It blocks while the peer has no room left
+// for more data.
 func (s *Stream) Write(p []byte) (int, error) {
 
-	buf := bytes.NewBuffer(p)
-	for buf.Len() > 0 {
+	s.cond.L.Lock()
+	wd := s.wd
+	s.cond.L.Unlock()
+	if !wd.IsZero() {
+		timer := time.AfterFunc(time.Until(wd), s.cond.Broadcast)
+		defer timer.Stop()
+	}
+
+	n := 0
+	for n < len(p) {
 
+		// Wait for the peer to have room, an error, stream close, or timeout.
+		s.cond.L.Lock()
+		for s.sendWindow == 0 && s.err == nil && (wd.IsZero() || time.Now().Before(wd)) {
+			s.cond.Wait()
+		}
 		if s.err != nil {
-			return len(p) - buf.Len(), s.err
+			err := s.err
+			s.cond.L.Unlock()
+			return n, err
+		}
+		if s.sendWindow == 0 {
+			s.cond.L.Unlock()
+			return n, os.ErrDeadlineExceeded
 		}
+		size := min(len(p)-n, maxPayloadSize, int(s.sendWindow))
+		s.sendWindow -= uint32(size)
+		s.cond.L.Unlock()
 
-		payload := buf.Next(maxPayloadSize)
+		payload := p[n : n+size]
 		h := frameHeader{
 			id:     s.id,
 			length: uint16(len(payload)),
@@ -159,10 +304,13 @@ func (s *Stream) Write(p []byte) (int, error) {
 
 		// write next frame's worth of data
 		if err := s.mux.bufferFrame(h, payload); err != nil {
-			return len(p) - buf.Len() - len(payload), err
+			return n, err
 		}
+		n += size
+		s.written.Add(uint64(size))
+		s.mux.bytesWritten.Add(uint64(size))
 	}
-	return len(p), nil
+	return n, nil
 }
 
 // Close closes the Stream. The underlying connection is not closed.
@@ -0,0 +1,79 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/Acebond/ReverseSocks5/acl"
+	"github.com/Acebond/ReverseSocks5/mux"
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// embeddedPolicy is the destination policy built into the agent, edit
+// policy.acl before building to scope an agent.
+//
+//go:embed policy.acl
+var embeddedPolicy string
+
+// loadPolicy returns the embedded policy followed by the rules in file, if
+// file is not empty.
+func loadPolicy(file string) (*acl.List, error) {
+	policy, err := acl.Parse(strings.NewReader(embeddedPolicy))
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		rules, err := acl.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		policy.Append(rules)
+	}
+	return policy, nil
+}
+
+// denied checks the agent's policy, and then serverRules, for dest, which
+// holds both the hostname and the address it resolved to for requests by
+// hostname. It returns the rule denying dest, or nil if dest is allowed.
+func (sf *SocksServer) denied(dest statute.AddrSpec, serverRules *acl.List) *acl.Rule {
+	req := acl.Request{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+	for _, rules := range []*acl.List{sf.policy, serverRules} {
+		if rule := rules.Match(req); rule != nil && rule.Action == acl.Deny {
+			return rule
+		}
+	}
+	return nil
+}
+
+// allowedIPs returns the addresses of dest that the agent's policy and
+// serverRules allow, and the rule denying the first address that is not
+// allowed.
+func (sf *SocksServer) allowedIPs(dest statute.AddrSpec, ips []net.IP, serverRules *acl.List) ([]net.IP, *acl.Rule) {
+	var allowed []net.IP
+	var denied *acl.Rule
+	for _, ip := range ips {
+		dest.IP = ip
+		if rule := sf.denied(dest, serverRules); rule == nil {
+			allowed = append(allowed, ip)
+		} else if denied == nil {
+			denied = rule
+		}
+	}
+	return allowed, denied
+}
+
+// readStreamRules returns the rules of the server's access control list that
+// the server sent on stream for the agent to check, or nil if it sent none.
+func readStreamRules(stream net.Conn) (*acl.List, error) {
+	s, ok := stream.(*mux.Stream)
+	if !ok || s.Report() == nil {
+		return nil, nil
+	}
+	var rules streamRules
+	if err := json.Unmarshal(s.Report(), &rules); err != nil {
+		return nil, err
+	}
+	return acl.Parse(strings.NewReader(rules.ACL))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A reverseServer is a running server. Its configuration can be replaced
+// while it runs: listeners are opened and closed to match, new connections
+// use the new users and rules, and connected agents are kept.
+type reverseServer struct {
+	agents  *agentRegistry
+	http    *httpProxy
+	admin   http.Handler
+	load    func() (ServerConfig, error)
+	current atomic.Pointer[serverSettings]
+	audit   auditLog
+
+	// mu serialises reloads, and guards listeners
+	mu        sync.Mutex
+	listeners map[string]*serverListener
+}
+
+// A serverListener is one of the listeners a configuration asks for. The
+// listeners look up the configuration for every connection, so they are kept
+// for as long as the configuration has a listener of the same kind on the
+// same address.
+type serverListener struct {
+	Kind    string // "agent", "socks", "http", "forward", "admin" or "metrics"
+	Address string
+	ln      net.Listener
+	serve   func(net.Listener)
+}
+
+// key identifies the listener across configurations.
+func (l *serverListener) key() string {
+	return l.Kind + " " + l.Address
+}
+
+func newReverseServer(agentWait time.Duration, load func() (ServerConfig, error)) *reverseServer {
+	s := &reverseServer{
+		agents:    newAgentRegistry(agentWait),
+		load:      load,
+		listeners: make(map[string]*serverListener),
+	}
+	s.http = newHTTPProxy(s)
+	s.admin = newAdminHandler(s)
+	return s
+}
+
+// settings returns the configuration in use.
+func (s *reverseServer) settings() *serverSettings {
+	return s.current.Load()
+}
+
+// reload reads the configuration again and applies it.
+func (s *reverseServer) reload() error {
+	config, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := s.apply(config); err != nil {
+		return err
+	}
+	slog.Info("Reloaded the configuration")
+	return nil
+}
+
+// apply switches to config. Nothing changes if the files it names cannot be
+// loaded or a new listener cannot be opened.
+func (s *reverseServer) apply(config ServerConfig) error {
+	settings, err := loadServerSettings(config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted, err := s.wantedListeners(settings.config)
+	if err != nil {
+		return err
+	}
+
+	// open the new listeners before touching anything else
+	var opened []*serverListener
+	for key, l := range wanted {
+		if _, ok := s.listeners[key]; ok {
+			continue
+		}
+		if l.ln, err = net.Listen("tcp", l.Address); err != nil {
+			for _, l := range opened {
+				l.ln.Close()
+			}
+			return err
+		}
+		opened = append(opened, l)
+	}
+	// reopened on every reload, so the file can be rotated
+	if err := s.audit.open(config.AuditFile, config.AuditChain); err != nil {
+		for _, l := range opened {
+			l.ln.Close()
+		}
+		return err
+	}
+
+	old := s.current.Swap(settings)
+	s.agents.setWaitTimeout(config.AgentWait)
+	// pooled HTTP connections were allowed by the old rules
+	s.http.closeIdleConnections()
+
+	for key, l := range s.listeners {
+		if _, ok := wanted[key]; !ok {
+			l.ln.Close()
+			delete(s.listeners, key)
+		}
+	}
+	for _, l := range opened {
+		s.listeners[l.key()] = l
+		go l.serve(l.ln)
+	}
+
+	for _, agent := range s.agents.list() {
+		syncReverseForwards(agent, config.ReverseForwards)
+	}
+
+	if settings.auth == nil && (old == nil || old.auth != nil) {
+		slog.Warn("No password configured, anyone will be able to connect to the SOCKS5 server")
+	}
+	return nil
+}
+
+// wantedListeners returns the listeners config asks for, by key.
+func (s *reverseServer) wantedListeners(config ServerConfig) (map[string]*serverListener, error) {
+	list := []*serverListener{
+		{Kind: "agent", Address: config.AgentListen, serve: s.serveAgents},
+		{Kind: "socks", Address: config.SocksListen, serve: s.serveSocks},
+	}
+	if config.HTTPListen != "" {
+		list = append(list, &serverListener{Kind: "http", Address: config.HTTPListen, serve: s.serveHTTP})
+	}
+	if config.AdminListen != "" {
+		list = append(list, &serverListener{Kind: "admin", Address: config.AdminListen, serve: s.serveAdmin})
+	}
+	if config.MetricsListen != "" {
+		list = append(list, &serverListener{
+			Kind:    "metrics",
+			Address: config.MetricsListen,
+			serve:   func(ln net.Listener) { serveMetrics(ln, s.serverMetrics) },
+		})
+	}
+	for _, lf := range config.Forwards {
+		list = append(list, &serverListener{
+			Kind:    "forward",
+			Address: lf.Listen,
+			serve:   func(ln net.Listener) { serveLocalForward(ln, lf.Listen, s) },
+		})
+	}
+
+	wanted := make(map[string]*serverListener, len(list))
+	for _, l := range list {
+		if _, ok := wanted[l.key()]; ok {
+			return nil, fmt.Errorf("more than one %s listener on %s", l.Kind, l.Address)
+		}
+		wanted[l.key()] = l
+	}
+	return wanted, nil
+}
+
+// listenerList returns the open listeners ordered by kind and address.
+func (s *reverseServer) listenerList() []*serverListener {
+	s.mu.Lock()
+	list := make([]*serverListener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		list = append(list, l)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+// openListener opens an agent, socks or http listener on address on top of
+// those of the configuration, until the next reload.
+func (s *reverseServer) openListener(kind, address string) (*serverListener, error) {
+	l := &serverListener{Kind: kind, Address: address}
+	switch kind {
+	case "agent":
+		l.serve = s.serveAgents
+	case "socks":
+		l.serve = s.serveSocks
+	case "http":
+		l.serve = s.serveHTTP
+	default:
+		return nil, fmt.Errorf("cannot open a listener of kind %q", kind)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.listeners[l.key()]; ok {
+		return nil, fmt.Errorf("there is already a %s listener on %s", kind, address)
+	}
+	var err error
+	if l.ln, err = net.Listen("tcp", address); err != nil {
+		return nil, err
+	}
+	s.listeners[l.key()] = l
+	go l.serve(l.ln)
+	return l, nil
+}
+
+// closeListener closes a listener until the next reload. Connections it
+// accepted are left alone.
+func (s *reverseServer) closeListener(kind, address string) error {
+	if kind == "admin" {
+		return errors.New("the admin listener cannot be closed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := kind + " " + address
+	l, ok := s.listeners[key]
+	if !ok {
+		return fmt.Errorf("no %s listener on %s", kind, address)
+	}
+	l.ln.Close()
+	delete(s.listeners, key)
+	return nil
+}
+
+// localForward returns the forward rule for the listener on listen.
+func (s *reverseServer) localForward(listen string) (localForward, bool) {
+	for _, lf := range s.settings().config.Forwards {
+		if lf.Listen == listen {
+			return lf, true
+		}
+	}
+	return localForward{}, false
+}
+
+// serveSocks serves socks clients until ln is closed.
+func (s *reverseServer) serveSocks(ln net.Listener) {
+	TunnelServer(ln, s)
+}
+
+// serveHTTP serves the HTTP proxy until ln is closed.
+func (s *reverseServer) serveHTTP(ln net.Listener) {
+	slog.Info("Listening for http proxy clients", "listen", ln.Addr().String())
+	http.Serve(ln, s.http) //nolint: errcheck
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialConfig holds how the agent resolves and connects to destinations.
+type DialConfig struct {
+	Servers     dnsServers   // DNS servers to query, the system's if empty
+	TCP         bool         // query Servers over TCP instead of UDP
+	DoH         string       // DNS over HTTPS URL, replaces Servers
+	Prefer      ipPreference // address family tried first
+	Timeout     time.Duration
+	CacheTTL    time.Duration // how long answers are cached, 0 to not cache
+	NegativeTTL time.Duration // how long failed lookups are cached
+}
+
+// dnsServers is a flag of DNS server addresses that may be given more than
+// once. The port defaults to 53.
+type dnsServers []string
+
+func (d *dnsServers) String() string { return strings.Join(*d, ",") }
+
+func (d *dnsServers) Set(server string) error {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("DNS server %q must be an IP address", host)
+	}
+	*d = append(*d, server)
+	return nil
+}
+
+func (d *dnsServers) repeatable() {}
+
+// ipPreference is a flag choosing the address family connected to first.
+type ipPreference string
+
+func (p *ipPreference) String() string { return string(*p) }
+
+func (p *ipPreference) Set(s string) error {
+	if s != "" && s != "ipv4" && s != "ipv6" {
+		return fmt.Errorf("address family must be ipv4 or ipv6, not %q", s)
+	}
+	*p = ipPreference(s)
+	return nil
+}
+
+// fallbackDelay is how long an attempt to connect to one address gets before
+// the next address is tried alongside it, as recommended by RFC 8305.
+const fallbackDelay = 250 * time.Millisecond
+
+// dnsCacheSize bounds the number of hostnames cached.
+const dnsCacheSize = 1024
+
+// A destDialer resolves and connects to destinations for the agent.
+type destDialer struct {
+	config   DialConfig
+	resolver *net.Resolver
+	servers  string // the servers queried, if not the system's
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// newDestDialer checks config and returns a dialer using it.
+func newDestDialer(config DialConfig) (*destDialer, error) {
+	d := &destDialer{
+		config:   config,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]dnsCacheEntry),
+	}
+
+	switch {
+	case config.DoH != "" && len(config.Servers) > 0:
+		return nil, errors.New("only one of DNS servers and a DNS over HTTPS URL can be configured")
+
+	case config.DoH != "":
+		u, err := url.Parse(config.DoH)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("DNS over HTTPS URL %q must be an https URL", config.DoH)
+		}
+		client := &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			MaxIdleConns:      4,
+			IdleConnTimeout:   90 * time.Second,
+		}}
+		d.servers = config.DoH
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client, url: config.DoH}, nil
+			},
+		}
+
+	case len(config.Servers) > 0 || config.TCP:
+		// The resolver dials each of the system's servers in turn, they are
+		// swapped for the configured ones.
+		var next atomic.Uint32
+		var dialer net.Dialer
+		d.servers = config.Servers.String()
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if len(config.Servers) > 0 {
+					address = config.Servers[int(next.Add(1)-1)%len(config.Servers)]
+				}
+				if config.TCP {
+					network = "tcp"
+				}
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+	}
+	return d, nil
+}
+
+// withTimeout returns a context that ends when the time to resolve and
+// connect to a destination is up. The same context is passed to lookup and
+// dial, so that the two together take no longer.
+func (d *destDialer) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.config.Timeout > 0 {
+		return context.WithTimeout(ctx, d.config.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// lookup returns the addresses of host, ordered as they should be tried.
+func (d *destDialer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	key := strings.ToLower(host)
+	now := time.Now()
+
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if !ok || !now.Before(entry.expires) {
+		entry = dnsCacheEntry{}
+		entry.ips, entry.err = d.resolver.LookupIP(ctx, "ip", host)
+		if entry.err == nil && len(entry.ips) == 0 {
+			entry.err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		var dnsErr *net.DNSError
+		if errors.As(entry.err, &dnsErr) && d.servers != "" {
+			// the resolver names the system's server it replaced
+			dnsErr.Server = d.servers
+		}
+		ttl := d.config.CacheTTL
+		if entry.err != nil {
+			ttl = d.config.NegativeTTL
+			// only answers are worth remembering, not our own failures
+			if dnsErr == nil || !dnsErr.IsNotFound {
+				ttl = 0
+			}
+		}
+		if ttl > 0 {
+			entry.expires = now.Add(ttl)
+			d.store(key, entry)
+		}
+	}
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return sortAddrs(entry.ips, d.config.Prefer), nil
+}
+
+// store caches entry, making room by dropping expired entries, or any entry
+// if none have expired.
+func (d *destDialer) store(key string, entry dnsCacheEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.cache) >= dnsCacheSize {
+		now := time.Now()
+		for k, e := range d.cache {
+			if !now.Before(e.expires) {
+				delete(d.cache, k)
+			}
+		}
+		for k := range d.cache {
+			if len(d.cache) < dnsCacheSize {
+				break
+			}
+			delete(d.cache, k)
+		}
+	}
+	d.cache[key] = entry
+}
+
+// sortAddrs orders ips for Happy Eyeballs, alternating between IPv6 and IPv4
+// starting with the preferred family, or the family of the first address if
+// there is no preference. The order within each family is kept.
+func sortAddrs(ips []net.IP, prefer ipPreference) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if prefer == "ipv4" || (prefer == "" && len(ips) > 0 && ips[0].To4() != nil) {
+		first, second = v4, v6
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dial connects to port on the first of ips to answer. As in Happy Eyeballs,
+// the next address is tried once the last has had fallbackDelay to connect,
+// or as soon as it fails, and the first connection made wins.
+func (d *destDialer) dial(ctx context.Context, network string, ips []net.IP, port int) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses to connect to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	var dialer net.Dialer
+	start := func(ip net.IP) {
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			results <- result{conn, err}
+		}()
+	}
+
+	var firstErr error
+	next, pending := 0, 0
+	for next < len(ips) || pending > 0 {
+		var fallback <-chan time.Time
+		if next < len(ips) {
+			if pending == 0 {
+				start(ips[next])
+				next, pending = next+1, pending+1
+				continue
+			}
+			fallback = time.After(fallbackDelay)
+		}
+
+		select {
+		case <-fallback:
+			start(ips[next])
+			next, pending = next+1, pending+1
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections that lose the race
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start(ips[next])
+				next, pending = next+1, pending+1
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// A dohConn sends a net.Resolver's queries to a DNS over HTTPS server (RFC
+// 8484). The resolver takes it for a TCP connection to a DNS server, so each
+// query and response is prefixed with its length.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+
+	query    bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.query.Write(p)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		c.query.Next(2)
+		response, err := c.exchange(c.query.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		c.response.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response))))
+		c.response.Write(response)
+	}
+	return len(p), nil
+}
+
+// exchange posts a query to the server and returns its response.
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, os.ErrDeadlineExceeded
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS server answered %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.response.Read(p)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+// dohAddr is the address of a DNS over HTTPS server, its URL.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
@@ -4,13 +4,44 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 
+	"github.com/Acebond/ReverseSocks5/acl"
+	"github.com/Acebond/ReverseSocks5/mux"
 	"github.com/Acebond/ReverseSocks5/statute"
 )
 
-// ServeConn is used to serve a single connection.
-func ServeConn(conn net.Conn) error {
+// A SocksServer serves the SOCKS5 requests the server sends to an agent over
+// its mux.
+type SocksServer struct {
+	session *mux.Mux
+	// destinations the agent refuses, whatever the server asks for
+	policy *acl.List
+	dialer *destDialer
+	logger *slog.Logger
+}
+
+// NewSocksServer creates a SocksServer for the given mux.
+func NewSocksServer(session *mux.Mux, policy *acl.List, dialer *destDialer, logger *slog.Logger) *SocksServer {
+	return &SocksServer{session: session, policy: policy, dialer: dialer, logger: logger}
+}
+
+// ServeConn is used to serve a single connection. Errors are logged as well
+// as returned.
+func (sf *SocksServer) ServeConn(conn net.Conn) error {
+	logger := sf.logger
+	if s, ok := conn.(*mux.Stream); ok {
+		logger = logger.With("stream", s.ID())
+	}
+	err := sf.serveConn(conn, logger)
+	if err != nil && err != mux.ErrPeerClosedStream {
+		logger.Warn("Request failed", "err", err)
+	}
+	return err
+}
+
+func (sf *SocksServer) serveConn(conn net.Conn, logger *slog.Logger) error {
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
@@ -27,16 +58,26 @@ func ServeConn(conn net.Conn) error {
 
 	if request.Request.Command != statute.CommandConnect &&
 		request.Request.Command != statute.CommandBind &&
-		request.Request.Command != statute.CommandAssociate {
+		request.Request.Command != statute.CommandAssociate &&
+		request.Request.Command != commandReverseListen {
 		if err := SendReply(conn, statute.RepCommandNotSupported, nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
 		return fmt.Errorf("unrecognized command[%d]", request.Request.Command)
 	}
 
+	if request.ServerRules, err = readStreamRules(conn); err != nil {
+		if err := SendReply(conn, statute.RepRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("failed to read the server's access control list, %w", err)
+	}
+
 	//request.AuthContext = authContext
 	request.LocalAddr = conn.LocalAddr()
 	request.RemoteAddr = conn.RemoteAddr()
+	request.Logger = logger.With("dest", request.RawDestAddr.String())
+	request.Logger.Debug("Socks request", "command", request.Command)
 	// Process the client request
-	return handleRequest(conn, request)
+	return sf.handleRequest(conn, request)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/Acebond/ReverseSocks5/acl"
+	"github.com/Acebond/ReverseSocks5/statute"
+)
+
+// handleSocks4Client serves a SOCKS4 or SOCKS4a client. The request is
+// translated to SOCKS5 before it is sent to the agent, and the agent's
+// replies are translated back, so agents only ever see SOCKS5.
+func handleSocks4Client(conn net.Conn, bufConn *bufio.Reader, agents *agentRegistry, authMethod Authenticator, rules *acl.List, logger *slog.Logger) {
+	request, err := statute.ParseRequest4(bufConn)
+	if err != nil {
+		logger.Warn("Failed to read socks4 request", "err", err)
+		return
+	}
+
+	reject := func() {
+		conn.Write(statute.Reply4{Response: statute.Rep4Rejected}.Bytes()) //nolint: errcheck
+	}
+
+	// SOCKS4 only carries a user id, it cannot satisfy a password
+	if authMethod.GetCode() != statute.MethodNoAuth {
+		reject()
+		metrics.authFailures.add("socks4", 1)
+		logger.Warn("Rejected socks4 client, authentication is required")
+		return
+	}
+
+	switch request.Command {
+	case statute.CommandConnect, statute.CommandBind:
+	default:
+		reject()
+		logger.Warn("Unsupported socks4 command", "command", request.Command)
+		return
+	}
+
+	// The user id is usually the client's login name, it only names an
+	// agent when it has the form "user@agent"
+	user, agent := request.UserID, ""
+	if strings.Contains(request.UserID, "@") {
+		user, agent = splitUsername(request.UserID)
+	}
+	logger = logger.With("user", user, "dest", request.DstAddr.String())
+	if !allowedAnyAgent(logger, rules, user, request.DstAddr) {
+		reject()
+		return
+	}
+	stream, a, err := agents.openStream(agent)
+	if err != nil {
+		reject()
+		logger.Warn("Failed to open a stream", "err", err)
+		return
+	}
+	defer stream.Close()
+	logger = withStream(logger, a, stream)
+	info := &streamInfo{Kind: "socks4", User: user, Source: conn.RemoteAddr().String(), Dest: request.DstAddr.String(), client: conn}
+	if !allowedOnStream(logger, rules, user, a, stream, request.DstAddr) {
+		info.reply = new(statute.RepRuleFailure)
+	}
+	setStreamInfo(stream, info)
+
+	if info.reply != nil {
+		reject()
+		return
+	}
+
+	if _, err := stream.Write(request.Request().Bytes()); err != nil {
+		logger.Warn("Failed to send the request to the agent", "err", err)
+		return
+	}
+
+	// BIND gets a second reply once the peer has connected
+	replies := 1
+	if request.Command == statute.CommandBind {
+		replies = 2
+	}
+	for i := 0; i < replies; i++ {
+		rep, err := statute.ParseReply(stream)
+		if err != nil {
+			reject()
+			logger.Warn("Failed to read reply", "err", err)
+			return
+		}
+		if _, err := conn.Write(statute.NewReply4(rep).Bytes()); err != nil {
+			logger.Warn("Failed to send reply", "err", err)
+			return
+		}
+		if rep.Response != statute.RepSuccess {
+			return
+		}
+	}
+	proxyStream(conn, bufConn, stream)
+}
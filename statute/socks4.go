@@ -0,0 +1,122 @@
+package statute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Request4 represents the SOCKS4 and SOCKS4a request
+// The SOCKS4 request is formed as follows:
+//
+//	+----+----+---------+-------+----------+------+
+//	| VN | CD | DSTPORT | DSTIP |  USERID  | NULL |
+//	+----+----+---------+-------+----------+------+
+//	| 1  | 1  |    2    |   4   | Variable |  1   |
+//	+----+----+---------+-------+----------+------+
+//
+// SOCKS4a clients that want the server to resolve the destination set DSTIP
+// to 0.0.0.x with x non-zero, and append the null terminated host name after
+// the USERID.
+type Request4 struct {
+	// Version of socks protocol for message
+	Version byte
+	// Socks Command "connect","bind"
+	Command byte
+	// DstAddr in socks message
+	DstAddr AddrSpec
+	// UserID in socks message
+	UserID string
+}
+
+// ParseRequest4 to request from io.Reader. The version byte is read as well,
+// it must be VersionSocks4.
+func ParseRequest4(r io.Reader) (req Request4, err error) {
+	tmp := make([]byte, 8)
+	if _, err = io.ReadFull(r, tmp); err != nil {
+		return req, fmt.Errorf("failed to get request, %v", err)
+	}
+	req.Version, req.Command = tmp[0], tmp[1]
+	if req.Version != VersionSocks4 {
+		return req, fmt.Errorf("unrecognized SOCKS version[%d]", req.Version)
+	}
+	req.DstAddr.Port = int(binary.BigEndian.Uint16(tmp[2:]))
+	req.DstAddr.AddrType = ATYPIPv4
+	req.DstAddr.IP = net.IPv4(tmp[4], tmp[5], tmp[6], tmp[7])
+
+	if req.UserID, err = readNullTerminated(r); err != nil {
+		return req, fmt.Errorf("failed to get request user id, %v", err)
+	}
+
+	// SOCKS4a
+	if tmp[4] == 0 && tmp[5] == 0 && tmp[6] == 0 && tmp[7] != 0 {
+		if req.DstAddr.FQDN, err = readNullTerminated(r); err != nil {
+			return req, fmt.Errorf("failed to get request host name, %v", err)
+		}
+		req.DstAddr.AddrType, req.DstAddr.IP = ATYPDomain, nil
+	}
+	return req, nil
+}
+
+// readNullTerminated reads a null terminated string of at most 255 bytes.
+func readNullTerminated(r io.Reader) (string, error) {
+	b := make([]byte, 0, 32)
+	c := []byte{0}
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(b), nil
+		}
+		if len(b) == 255 {
+			return "", fmt.Errorf("string too long")
+		}
+		b = append(b, c[0])
+	}
+}
+
+// Request returns the equivalent SOCKS5 request
+func (h Request4) Request() Request {
+	return Request{
+		Version: VersionSocks5,
+		Command: h.Command,
+		DstAddr: h.DstAddr,
+	}
+}
+
+// Reply4 represents the SOCKS4 reply
+// The SOCKS4 reply is formed as follows:
+//
+//	+----+----+---------+-------+
+//	| VN | CD | DSTPORT | DSTIP |
+//	+----+----+---------+-------+
+//	| 1  | 1  |    2    |   4   |
+//	+----+----+---------+-------+
+type Reply4 struct {
+	// Socks Response status
+	Response byte
+	// Bind Address in socks message, only IPv4 can be represented
+	BndAddr AddrSpec
+}
+
+// NewReply4 returns the SOCKS4 reply equivalent to a SOCKS5 reply
+func NewReply4(rep Reply) Reply4 {
+	r := Reply4{Response: Rep4Granted, BndAddr: rep.BndAddr}
+	if rep.Response != RepSuccess {
+		r.Response = Rep4Rejected
+	}
+	return r
+}
+
+// Bytes returns a slice of reply
+func (sf Reply4) Bytes() []byte {
+	b := make([]byte, 8)
+	b[1] = sf.Response
+	binary.BigEndian.PutUint16(b[2:], uint16(sf.BndAddr.Port))
+	if ip4 := sf.BndAddr.IP.To4(); ip4 != nil {
+		copy(b[4:], ip4)
+	}
+	return b
+}
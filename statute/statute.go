@@ -7,6 +7,9 @@ import (
 // VersionSocks5 socks protocol version
 const VersionSocks5 = byte(0x05)
 
+// VersionSocks4 socks4 and socks4a protocol version
+const VersionSocks4 = byte(0x04)
+
 // request command defined
 const (
 	CommandConnect   = byte(0x01)
@@ -43,6 +46,12 @@ const (
 	// 0x09 - 0xff unassigned
 )
 
+// socks4 reply status
+const (
+	Rep4Granted  = byte(0x5a)
+	Rep4Rejected = byte(0x5b)
+)
+
 // auth defined
 const (
 	// user password version